@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	notify "github.com/anthonybliss1/go-apts/internal/notify"
+)
+
+// RFC 7807 problem details. Code is the stable field scripts should branch on, Detail is for humans
+type Problem struct {
+	Type           string `json:"type"`
+	Title          string `json:"title"`
+	Status         int    `json:"status"`
+	Code           string `json:"code"`
+	Detail         string `json:"detail"`
+	UpstreamStatus int    `json:"upstream_status,omitempty"`
+}
+
+type error_mapping struct {
+	kind   error
+	code   string
+	status int
+}
+
+// the one place error kinds turn into status codes, first match wins
+var error_mappings = []error_mapping{
+	{utils.ErrInvalidURL, "invalid_url", http.StatusBadRequest},
+	{utils.ErrUnsupportedHost, "unsupported_host", http.StatusBadRequest},
+	{utils.ErrRateLimited, "rate_limited", http.StatusTooManyRequests},
+	{utils.ErrParse, "parse_failure", http.StatusUnprocessableEntity},
+	{utils.ErrBlocked, "blocked", http.StatusServiceUnavailable},
+	{utils.ErrShuttingDown, "shutting_down", http.StatusServiceUnavailable},
+	{utils.ErrUpstreamStatus, "upstream_status", http.StatusBadGateway},
+	{utils.ErrUnreachable, "upstream_unreachable", http.StatusBadGateway},
+	{notify.ErrPreviouslyFailed, "previously_failed", http.StatusConflict},
+	{utils.ErrNotifier, "notifier_failure", http.StatusBadGateway},
+	{utils.ErrTimeout, "timeout", http.StatusGatewayTimeout},
+	{context.DeadlineExceeded, "timeout", http.StatusGatewayTimeout},
+	{context.Canceled, "client_closed_request", status_client_closed},
+}
+
+// nginx's code for a client that hung up before we answered, nobody reads the response but it keeps the logs honest
+const status_client_closed = 499
+
+func Problem_for(err error) Problem {
+	p := Problem{Code: "internal", Status: http.StatusInternalServerError, Detail: err.Error()}
+
+	for _, m := range error_mappings {
+		if errors.Is(err, m.kind) {
+			p.Code = m.code
+			p.Status = m.status
+			break
+		}
+	}
+
+	var apts_err *utils.Apts_error
+	if errors.As(err, &apts_err) {
+		p.UpstreamStatus = apts_err.Status
+	}
+
+	p.Type = problem_type(p.Code)
+	p.Title = status_text(p.Status)
+	return p
+}
+
+func status_text(status int) string {
+	if status == status_client_closed {
+		return "Client Closed Request"
+	}
+	return http.StatusText(status)
+}
+
+func problem_type(code string) string {
+	return "https://github.com/AnthonyBliss1/go-apts#error-" + code
+}
+
+func Write_error(w http.ResponseWriter, err error) {
+	p := Problem_for(err)
+
+	// tell well-behaved callers when to come back
+	if p.Status == http.StatusTooManyRequests || p.Status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "60")
+	}
+	Write_problem(w, p)
+}
+
+// for errors that come from the request itself rather than a scrape
+func Bad_request(w http.ResponseWriter, code string, detail string) {
+	Request_error(w, http.StatusBadRequest, code, detail)
+}
+
+func Request_error(w http.ResponseWriter, status int, code string, detail string) {
+	Write_problem(w, Problem{
+		Type:   problem_type(code),
+		Title:  status_text(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	})
+}
+
+func Write_problem(w http.ResponseWriter, p Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Printf("failed to write problem JSON: %v\n", err)
+	}
+}
@@ -2,50 +2,96 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
 
 	utils "github.com/anthonybliss1/go-apts/api/utils"
+	notify "github.com/anthonybliss1/go-apts/internal/notify"
+	watch "github.com/anthonybliss1/go-apts/internal/watch"
 )
 
 func Scrape_handler(client *http.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		raw_url := r.URL.Query().Get("url")
 		if raw_url == "" {
-			http.Error(w, "`url` query parameter is required", http.StatusBadRequest)
+			Bad_request(w, "missing_url", "`url` query parameter is required")
 			return
 		}
 
-		records, _, err := utils.Scrape_apartment_listing(raw_url, client)
+		// callers can force a fresh scrape with Cache-Control: no-cache
+		force := strings.Contains(strings.ToLower(r.Header.Get("Cache-Control")), "no-cache")
+
+		result, status, err := utils.Scrape_listing_cached(r.Context(), raw_url, client, force)
+		w.Header().Set("X-Cache", string(status))
 		if err != nil {
-			if strings.HasPrefix(err.Error(), "unsupported host") || strings.HasPrefix(err.Error(), "invalid URL") {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-			} else {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
+			Write_error(w, err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 
-		if err := json.NewEncoder(w).Encode(records); err != nil {
+		if err := json.NewEncoder(w).Encode(result.Records); err != nil {
 			log.Printf("failed to write JSON: %v\n", err)
 		}
 	}
 }
 
-func Chat_handler(client *http.Client) http.HandlerFunc {
+func Chat_handler(client *http.Client, watches *watch.Watches) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		raw_url := r.URL.Query().Get("url")
-		if raw_url == "" {
-			http.Error(w, "`url` query parameter is required", http.StatusBadRequest)
+		// a one-off watch for ?url=, or the stored one for ?watch=<id>
+		wt := watch.Watch{URL: r.URL.Query().Get("url"), Channels: notify.Default_channels()}
+
+		if id := r.URL.Query().Get("watch"); id != "" {
+			stored, found, err := watches.Get(id)
+			if err != nil {
+				Write_error(w, err)
+				return
+			}
+			if !found {
+				Request_error(w, http.StatusNotFound, "watch_not_found", fmt.Sprintf("no watch with id %q", id))
+				return
+			}
+			wt = stored
+		}
+
+		// ?channels=telegram,slack overrides both
+		if v := r.URL.Query().Get("channels"); v != "" {
+			wt.Channels = split_list(v)
+		}
+
+		if wt.URL == "" {
+			Bad_request(w, "missing_url", "`url` query parameter is required")
+			return
+		}
+
+		if _, err := notify.Channels.Resolve(wt.Channels); err != nil {
+			Bad_request(w, "unknown_channel", err.Error())
+			return
+		}
+		if only := notify.Channels.Rule_only_channels(wt.Channels); len(only) > 0 {
+			Bad_request(w, "channel_not_allowed", fmt.Sprintf("%s can only be used on a high priority rule", only[0]))
 			return
 		}
 
-		if err := utils.Send_notification(raw_url, client); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		force := strings.Contains(strings.ToLower(r.Header.Get("Cache-Control")), "no-cache")
+
+		// a cron script retrying with the same Idempotency-Key won't send twice
+		ctx := r.Context()
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			ctx = notify.With_idempotency_key(ctx, key)
+		}
+
+		if err := notify.Send_watch(ctx, wt, client, force); err != nil {
+			// the outbox has it and keeps retrying, nothing for the caller to redo
+			if errors.Is(err, notify.ErrQueued) {
+				write_json(w, http.StatusAccepted, map[string]string{"status": "queued", "detail": err.Error()})
+				return
+			}
+			Write_error(w, err)
 			return
 		}
 
@@ -53,3 +99,39 @@ func Chat_handler(client *http.Client) http.HandlerFunc {
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+func split_list(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// per-provider parse stats, so a markup change on a provider shows up here before tenants notice
+func Parser_health_handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		if err := json.NewEncoder(w).Encode(utils.Parse_health.Stats()); err != nil {
+			log.Printf("failed to write JSON: %v\n", err)
+		}
+	}
+}
+
+// recent webhook deliveries per endpoint, to debug a receiver without digging through logs
+func Webhook_deliveries_handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, ok := notify.Channels.Get("webhook")
+		webhook, is_webhook := n.(*notify.Webhook)
+		if !ok || !is_webhook {
+			Request_error(w, http.StatusNotFound, "channel_not_configured", "the webhook channel is not configured")
+			return
+		}
+
+		write_json(w, http.StatusOK, webhook.Deliveries())
+	}
+}
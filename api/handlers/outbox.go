@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	notify "github.com/anthonybliss1/go-apts/internal/notify"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// outbox entries without the full alert, which can be hundreds of units
+type outbox_view struct {
+	ID          string     `json:"id"`
+	Channel     string     `json:"channel"`
+	Status      string     `json:"status"`
+	ListingURL  string     `json:"listing_url,omitempty"`
+	ListingName string     `json:"listing_name,omitempty"`
+	WatchID     string     `json:"watch_id,omitempty"`
+	Digest      int        `json:"digest_listings,omitempty"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	SentAt      *time.Time `json:"sent_at,omitempty"`
+}
+
+func new_outbox_view(entry notify.Outbox_entry) outbox_view {
+	view := outbox_view{
+		ID:          entry.ID,
+		Channel:     entry.Channel,
+		Status:      entry.Status,
+		ListingURL:  entry.Alert.ListingURL,
+		ListingName: entry.Alert.ListingName,
+		WatchID:     entry.Alert.WatchID,
+		Digest:      len(entry.Alert.Digest),
+		Attempts:    entry.Attempts,
+		LastError:   entry.LastError,
+		CreatedAt:   entry.CreatedAt,
+	}
+	if entry.Status == notify.Outbox_pending {
+		view.NextAttempt = &entry.NextAttempt
+	}
+	if entry.Status == notify.Outbox_sent {
+		view.SentAt = &entry.SentAt
+	}
+	return view
+}
+
+// Outbox_list_handler lists outbox entries, ?status=failed for the ones that ran out of retries
+func Outbox_list_handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "", notify.Outbox_pending, notify.Outbox_sent, notify.Outbox_failed:
+		default:
+			Bad_request(w, "invalid_status", fmt.Sprintf("status must be pending, sent or failed, got %q", status))
+			return
+		}
+
+		views := []outbox_view{}
+		for _, entry := range notify.Outgoing.List(status) {
+			views = append(views, new_outbox_view(entry))
+		}
+		write_json(w, http.StatusOK, views)
+	}
+}
+
+// Outbox_replay_handler resends one entry now with a fresh set of retries
+func Outbox_replay_handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		entry, found, err := notify.Outgoing.Replay(r.Context(), id)
+		if errors.Is(err, notify.ErrAlreadySent) {
+			Request_error(w, http.StatusConflict, "already_sent", err.Error())
+			return
+		}
+		if err != nil {
+			Write_error(w, err)
+			return
+		}
+		if !found {
+			Request_error(w, http.StatusNotFound, "outbox_entry_not_found", fmt.Sprintf("no outbox entry with id %q", id))
+			return
+		}
+
+		// a failed replay is back in the retry queue, the entry says how it went
+		write_json(w, http.StatusOK, new_outbox_view(entry))
+	}
+}
+
+// Outbox_replay_failed_handler replays every failed entry
+func Outbox_replay_failed_handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		views := []outbox_view{}
+		for _, failed := range notify.Outgoing.List(notify.Outbox_failed) {
+			entry, _, err := notify.Outgoing.Replay(r.Context(), failed.ID)
+			if err != nil {
+				Write_error(w, err)
+				return
+			}
+			views = append(views, new_outbox_view(entry))
+		}
+		write_json(w, http.StatusOK, views)
+	}
+}
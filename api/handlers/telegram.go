@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	bot "github.com/anthonybliss1/go-apts/internal/bot"
+	notify "github.com/anthonybliss1/go-apts/internal/notify"
+)
+
+// Telegram_webhook_handler takes bot updates pushed by telegram (notifiers.telegram.commands: webhook)
+func Telegram_webhook_handler(b *bot.Bot) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the config requires a secret for webhook mode, without one nothing gets in
+		got := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+		if b.Secret == "" || subtle.ConstantTimeCompare([]byte(got), []byte(b.Secret)) != 1 {
+			Request_error(w, http.StatusUnauthorized, "bad_secret", "missing or wrong X-Telegram-Bot-Api-Secret-Token")
+			return
+		}
+
+		var u notify.Update
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			Bad_request(w, "invalid_body", err.Error())
+			return
+		}
+
+		// answer telegram straight away, it retries updates that take too long
+		b.Go(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			defer cancel()
+			b.Handle(ctx, u)
+		})
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	notify "github.com/anthonybliss1/go-apts/internal/notify"
+	watch "github.com/anthonybliss1/go-apts/internal/watch"
+)
+
+type preview_request struct {
+	Template string // template text, empty to preview whatever the channel / watch would use
+	Channel  string // picks the channel's template when Template is empty
+	Watch    string // watch id, for its URL, templates and target rent
+	URL      string
+	Stored   bool // render the last recorded scrape instead of scraping now
+}
+
+type preview_response struct {
+	Rendered  string `json:"rendered"`
+	Source    string `json:"source"` // live or stored
+	Template  string `json:"template"`
+	ScrapedAt string `json:"scraped_at"`
+}
+
+// Template_preview_handler renders a notification template against a live or stored scrape without sending it
+func Template_preview_handler(client *http.Client, watches *watch.Watches) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body preview_request
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			Bad_request(w, "invalid_body", fmt.Sprintf("decoding preview JSON: %v", err))
+			return
+		}
+
+		var wt watch.Watch
+		if body.Watch != "" {
+			found := false
+			var err error
+			wt, found, err = watches.Get(body.Watch)
+			if err != nil {
+				Write_error(w, err)
+				return
+			}
+			if !found {
+				Request_error(w, http.StatusNotFound, "watch_not_found", fmt.Sprintf("no watch with id %q", body.Watch))
+				return
+			}
+			if body.URL == "" {
+				body.URL = wt.URL
+			}
+		}
+		if body.URL == "" {
+			Bad_request(w, "missing_url", "preview needs a url or a watch")
+			return
+		}
+
+		// the channel names a template file, so only take the ones that exist
+		if body.Channel != "" && body.Channel != notify.Template_default {
+			if _, err := notify.Channels.Resolve([]string{body.Channel}); err != nil {
+				Bad_request(w, "unknown_channel", err.Error())
+				return
+			}
+		}
+
+		// a bad template is the caller's mistake, catch it before scraping anything
+		if body.Template != "" {
+			if _, err := notify.Parse_template(body.Template); err != nil {
+				Bad_request(w, "invalid_template", err.Error())
+				return
+			}
+		}
+
+		alert, found, err := notify.Preview_alert(r.Context(), body.URL, client, body.Stored)
+		if err != nil {
+			Write_error(w, err)
+			return
+		}
+		if !found {
+			Request_error(w, http.StatusNotFound, "no_stored_scrape", fmt.Sprintf("nothing recorded for %s yet, preview it live instead", body.URL))
+			return
+		}
+		alert.WatchID = wt.ID
+		alert.Targets = wt.Targets
+		alert.TargetRent = wt.TargetRent
+		alert.Templates = wt.Templates
+
+		text := body.Template
+		if text == "" {
+			channel_text, found, err := notify.Channel_template(alert, body.Channel)
+			if err != nil {
+				Write_error(w, err)
+				return
+			}
+			text = notify.Default_template
+			if found {
+				text = channel_text
+			}
+		}
+
+		rendered, err := notify.Render_template(text, alert)
+		if err != nil {
+			Bad_request(w, "invalid_template", err.Error())
+			return
+		}
+
+		source := "live"
+		if body.Stored {
+			source = "stored"
+		}
+		write_json(w, http.StatusOK, preview_response{
+			Rendered:  rendered,
+			Source:    source,
+			Template:  text,
+			ScrapedAt: alert.ScrapedAt.Format(time.RFC3339),
+		})
+	}
+}
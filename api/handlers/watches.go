@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	digest "github.com/anthonybliss1/go-apts/internal/digest"
+	notify "github.com/anthonybliss1/go-apts/internal/notify"
+	rules "github.com/anthonybliss1/go-apts/internal/rules"
+	watch "github.com/anthonybliss1/go-apts/internal/watch"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type watch_request struct {
+	URL        string
+	Channels   []string
+	Targets    map[string]string
+	TargetRent float64
+	Interval   string
+	Templates  map[string]string
+	Delivery   map[string]digest.Policy
+	Rules      []rules.Rule
+}
+
+func Watches_list_handler(watches *watch.Watches) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		all, err := watches.List()
+		if err != nil {
+			Write_error(w, err)
+			return
+		}
+		if all == nil {
+			all = []watch.Watch{}
+		}
+
+		write_json(w, http.StatusOK, all)
+	}
+}
+
+func Watch_create_handler(watches *watch.Watches) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body watch_request
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			Bad_request(w, "invalid_body", fmt.Sprintf("decoding watch JSON: %v", err))
+			return
+		}
+
+		if parsed, err := url.Parse(body.URL); err != nil || parsed.Host == "" {
+			Bad_request(w, "invalid_url", fmt.Sprintf("%q is not a listing URL", body.URL))
+			return
+		}
+
+		if !watch.Valid_interval(body.Interval) {
+			Bad_request(w, "invalid_interval", fmt.Sprintf("interval must be hourly, daily or weekly, got %q", body.Interval))
+			return
+		}
+
+		if len(body.Channels) == 0 {
+			body.Channels = notify.Default_channels()
+		}
+		if _, err := notify.Channels.Resolve(body.Channels); err != nil {
+			Bad_request(w, "unknown_channel", err.Error())
+			return
+		}
+		if only := notify.Channels.Rule_only_channels(body.Channels); len(only) > 0 {
+			Bad_request(w, "channel_not_allowed", fmt.Sprintf("%s can only be used on a high priority rule, not on the watch", only[0]))
+			return
+		}
+
+		for channel, text := range body.Templates {
+			if _, err := notify.Parse_template(text); err != nil {
+				Bad_request(w, "invalid_template", fmt.Sprintf("%s template: %v", channel, err))
+				return
+			}
+		}
+
+		for channel, policy := range body.Delivery {
+			if err := policy.Validate(); err != nil {
+				Bad_request(w, "invalid_delivery", fmt.Sprintf("delivery.%s.%v", channel, err))
+				return
+			}
+		}
+
+		for i, rule := range body.Rules {
+			if err := rule.Validate(); err != nil {
+				Bad_request(w, "invalid_rule", fmt.Sprintf("rules[%d]: %v", i, err))
+				return
+			}
+			if rule.Type == rules.Under_target && rule.TargetRent == 0 && body.TargetRent == 0 {
+				Bad_request(w, "invalid_rule", fmt.Sprintf("rules[%d]: TargetRent is required when the watch has no TargetRent", i))
+				return
+			}
+			if _, err := notify.Channels.Resolve(rule.Channels); err != nil {
+				Bad_request(w, "unknown_channel", fmt.Sprintf("rules[%d]: %v", i, err))
+				return
+			}
+			if only := notify.Channels.Rule_only_channels(rule.Channels); len(only) > 0 && rule.Priority_name() != rules.Priority_high {
+				Bad_request(w, "invalid_rule", fmt.Sprintf("rules[%d]: Channels: %s needs Priority high, got %q", i, only[0], rule.Priority))
+				return
+			}
+		}
+
+		wt, err := watches.Add(watch.Watch{
+			URL:        body.URL,
+			Channels:   body.Channels,
+			Targets:    body.Targets,
+			TargetRent: body.TargetRent,
+			Interval:   body.Interval,
+			Templates:  body.Templates,
+			Delivery:   body.Delivery,
+			Rules:      body.Rules,
+		})
+		if err != nil {
+			Write_error(w, err)
+			return
+		}
+
+		write_json(w, http.StatusCreated, wt)
+	}
+}
+
+func Watch_delete_handler(watches *watch.Watches) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		_, found, err := watches.Get(id)
+		if err != nil {
+			Write_error(w, err)
+			return
+		}
+		if !found {
+			Request_error(w, http.StatusNotFound, "watch_not_found", fmt.Sprintf("no watch with id %q", id))
+			return
+		}
+
+		if err := watches.Remove(id); err != nil {
+			Write_error(w, err)
+			return
+		}
+		if err := notify.Unit_history.Forget(id); err != nil {
+			log.Printf("removing history of watch %s: %v\n", id, err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func write_json(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write JSON: %v\n", err)
+	}
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// kinds of failure callers can branch on with errors.Is. handlers.Write_error maps each one to a status code
+var (
+	ErrInvalidURL      = errors.New("invalid URL")
+	ErrUnsupportedHost = errors.New("unsupported host")
+	ErrUpstreamStatus  = errors.New("unexpected upstream status")
+	ErrUnreachable     = errors.New("upstream unreachable")
+	ErrBlocked         = errors.New("blocked by provider")
+	ErrParse           = errors.New("parse failure")
+	ErrTimeout         = errors.New("upstream timeout")
+	ErrRateLimited     = errors.New("rate limited")
+	ErrNotifier        = errors.New("notifier failure")
+	ErrShuttingDown    = errors.New("shutting down")
+)
+
+// Apts_error wraps the underlying error with one of the kinds above so both survive errors.Is / errors.As
+type Apts_error struct {
+	Kind   error
+	Detail string
+	Status int // status code the upstream answered with, 0 if we never got a response
+	Err    error
+}
+
+func (e *Apts_error) Error() string {
+	parts := []string{e.Kind.Error()}
+	if e.Detail != "" {
+		parts = append(parts, e.Detail)
+	}
+	if e.Err != nil {
+		parts = append(parts, e.Err.Error())
+	}
+	return strings.Join(parts, ": ")
+}
+
+func (e *Apts_error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+func New_error(kind error, detail string, err error) error {
+	return &Apts_error{Kind: kind, Detail: detail, Err: err}
+}
+
+// a failed client.Do is a timeout if a deadline ran out anywhere along the way
+func request_error(detail string, err error) error {
+	var net_err net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &net_err) && net_err.Timeout()) {
+		return New_error(ErrTimeout, detail, err)
+	}
+	return New_error(ErrUnreachable, detail, err)
+}
+
+// 403 / 429 mean the provider has flagged us, anything else that isn't a 200 is just a bad answer
+func status_error(host string, status int) error {
+	kind := ErrUpstreamStatus
+	if status == 403 || status == 429 {
+		kind = ErrBlocked
+	}
+	return &Apts_error{Kind: kind, Detail: fmt.Sprintf("received status %d from %s", status, host), Status: status}
+}
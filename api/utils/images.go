@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"encoding/json"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// how many building photos are kept per scrape
+const max_listing_photos = 10
+
+var og_image_pattern = regexp.MustCompile(`<meta[^>]+property="og:image"[^>]+content="([^"]+)"`)
+
+// gallery images are served from apartments.com's image host
+var photo_pattern = regexp.MustCompile(`https://images\d*\.apartments\.com/[^"'\s<>()\\]+\.(?:jpe?g|png|webp)`)
+
+var image_extension = regexp.MustCompile(`(?i)\.(?:jpe?g|png|webp)(?:\?|$)`)
+
+// listing_photos pulls building photo URLs out of the page, the og:image (the cover photo) first
+func listing_photos(page string, max int) []string {
+	var photos []string
+	seen := make(map[string]bool)
+	add := func(u string) {
+		u = html.UnescapeString(u)
+		if len(photos) < max && !seen[u] && strings.HasPrefix(u, "https://") {
+			seen[u] = true
+			photos = append(photos, u)
+		}
+	}
+
+	if m := og_image_pattern.FindStringSubmatch(page); len(m) > 1 {
+		add(m[1])
+	}
+	for _, u := range photo_pattern.FindAllString(page, -1) {
+		add(u)
+	}
+	return photos
+}
+
+// attach_floor_plans sets FloorPlanURL on units whose entry in the rentals blob has a floor plan image.
+// the blob's field names for it have changed before, so any image url under a key mentioning
+// "floorplan" or "image" is taken
+func attach_floor_plans(data []byte, units []Apartments) {
+	var raw []map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil || len(raw) != len(units) {
+		return
+	}
+
+	for i, fields := range raw {
+		if units[i].FloorPlanURL == "" {
+			units[i].FloorPlanURL = find_image(fields, 0)
+		}
+	}
+}
+
+func find_image(v any, depth int) string {
+	if depth > 3 {
+		return ""
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			k := strings.ToLower(key)
+			if !strings.Contains(k, "floorplan") && !strings.Contains(k, "image") {
+				continue
+			}
+			if s, ok := value.(string); ok && is_image_url(s) {
+				return s
+			}
+			if found := find_image(value, depth+1); found != "" {
+				return found
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok && is_image_url(s) {
+				return s
+			}
+			if found := find_image(item, depth+1); found != "" {
+				return found
+			}
+		}
+	}
+	return ""
+}
+
+func is_image_url(s string) bool {
+	return strings.HasPrefix(s, "https://") && image_extension.MatchString(s)
+}
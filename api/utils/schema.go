@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// fields of the rentals blob that Apartments is built from. if one of these disappears from every unit
+// the scrape still "works" but reports zeros, so it's treated as a schema change
+var rentals_fields = []string{"Name", "UnitNumber", "Beds", "Baths", "SquareFeet", "Rent", "AvailableDateText"}
+
+// returns the expected fields that none of the units in the blob have
+func check_rentals_schema(data []byte) ([]string, error) {
+	var units []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &units); err != nil {
+		return nil, err
+	}
+	if len(units) == 0 {
+		return nil, nil
+	}
+
+	var missing []string
+	for _, field := range rentals_fields {
+		found := false
+		for _, unit := range units {
+			if _, ok := unit[field]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, field)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
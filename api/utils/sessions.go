@@ -0,0 +1,364 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a set of headers that all describe the same browser. mixing a random UA with fixed client hints
+// (Chrome UA + macOS hints on a Windows UA, etc.) is one of the easiest bot signals to spot
+type Header_profile struct {
+	Name           string
+	UserAgent      string
+	SecCHUA        string // empty for browsers that don't send client hints (Firefox, Safari)
+	Platform       string
+	Accept         string
+	AcceptLanguage string
+}
+
+const chromium_accept = "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7"
+
+var Header_profiles = []Header_profile{
+	{
+		Name:           "chrome-macos",
+		UserAgent:      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/132.0.0.0 Safari/537.36",
+		SecCHUA:        `"Not A(Brand";v="8", "Chromium";v="132", "Google Chrome";v="132"`,
+		Platform:       `"macOS"`,
+		Accept:         chromium_accept,
+		AcceptLanguage: "en-US,en;q=0.9",
+	},
+	{
+		Name:           "chrome-windows",
+		UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36",
+		SecCHUA:        `"Google Chrome";v="131", "Chromium";v="131", "Not_A Brand";v="24"`,
+		Platform:       `"Windows"`,
+		Accept:         chromium_accept,
+		AcceptLanguage: "en-US,en;q=0.9",
+	},
+	{
+		Name:           "edge-windows",
+		UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36 Edg/131.0.0.0",
+		SecCHUA:        `"Microsoft Edge";v="131", "Chromium";v="131", "Not_A Brand";v="24"`,
+		Platform:       `"Windows"`,
+		Accept:         chromium_accept,
+		AcceptLanguage: "en-US,en;q=0.9",
+	},
+	{
+		Name:           "chrome-linux",
+		UserAgent:      "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/132.0.0.0 Safari/537.36",
+		SecCHUA:        `"Not A(Brand";v="8", "Chromium";v="132", "Google Chrome";v="132"`,
+		Platform:       `"Linux"`,
+		Accept:         chromium_accept,
+		AcceptLanguage: "en-US,en;q=0.9",
+	},
+	{
+		Name:           "firefox-windows",
+		UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:133.0) Gecko/20100101 Firefox/133.0",
+		Accept:         "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		AcceptLanguage: "en-US,en;q=0.5",
+	},
+	{
+		Name:           "safari-macos",
+		UserAgent:      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.1 Safari/605.1.15",
+		Accept:         "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		AcceptLanguage: "en-US,en;q=0.9",
+	},
+}
+
+func (p Header_profile) Apply(req *http.Request) {
+	req.Header.Set("accept", p.Accept)
+	req.Header.Set("accept-language", p.AcceptLanguage)
+	req.Header.Set("cache-control", "no-cache")
+	req.Header.Set("pragma", "no-cache")
+	if p.SecCHUA != "" {
+		req.Header.Set("sec-ch-ua", p.SecCHUA)
+		req.Header.Set("sec-ch-ua-mobile", "?0")
+		req.Header.Set("sec-ch-ua-platform", p.Platform)
+	}
+	req.Header.Set("sec-fetch-dest", "document")
+	req.Header.Set("sec-fetch-mode", "navigate")
+	req.Header.Set("sec-fetch-site", "none")
+	req.Header.Set("sec-fetch-user", "?1")
+	req.Header.Set("upgrade-insecure-requests", "1")
+	req.Header.Set("user-agent", p.UserAgent)
+}
+
+// sessions get a fresh browser identity after this long, or right away if the host starts blocking us
+const session_max_age = 24 * time.Hour
+
+// one returning "browser" per host: the same header profile and a cookie jar carried across scrapes
+type Browser_session struct {
+	Profile Header_profile
+	Jar     http.CookieJar
+	jar     *recording_jar
+	started time.Time
+}
+
+// what gets written to disk so sessions survive a restart of the service
+type saved_session struct {
+	Profile string
+	Started time.Time
+	Cookies []saved_cookie
+}
+
+// a cookie as the host set it (Domain, Path, Expires, Secure and all) and the page that set it, so the jar
+// scopes it the same way when it's loaded back. jar.Cookies(u) only gives back name and value
+type saved_cookie struct {
+	URL    string
+	Cookie *http.Cookie
+}
+
+// recording_jar is a cookiejar that also keeps the full Set-Cookie records it was handed
+type recording_jar struct {
+	*cookiejar.Jar
+	mu      sync.Mutex
+	cookies map[string]saved_cookie
+	changed bool
+}
+
+func new_recording_jar() *recording_jar {
+	jar, _ := cookiejar.New(nil)
+	return &recording_jar{Jar: jar, cookies: make(map[string]saved_cookie)}
+}
+
+// a refreshed Max-Age moves Expires on every response, that alone isn't worth rewriting the file for
+const expiry_slack = time.Minute
+
+func (j *recording_jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	origin := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+	for _, c := range cookies {
+		record := *c
+		record.Raw = ""
+		// Max-Age is relative to now, store it as an absolute expiry so it still means the same after a restart
+		if record.MaxAge > 0 {
+			record.Expires = now.Add(time.Duration(record.MaxAge) * time.Second)
+			record.MaxAge = 0
+		}
+
+		key := cookie_key(u, &record)
+		if record.MaxAge < 0 || (!record.Expires.IsZero() && !record.Expires.After(now)) {
+			if _, ok := j.cookies[key]; ok {
+				delete(j.cookies, key)
+				j.changed = true
+			}
+			continue
+		}
+
+		if prev, ok := j.cookies[key]; ok && prev.URL == origin && same_cookie(prev.Cookie, &record) {
+			continue
+		}
+		j.cookies[key] = saved_cookie{URL: origin, Cookie: &record}
+		j.changed = true
+	}
+}
+
+// loads cookies saved by an earlier run without counting them as a change
+func (j *recording_jar) restore(saved []saved_cookie) {
+	for _, sc := range saved {
+		if sc.Cookie == nil {
+			continue
+		}
+		u, err := url.Parse(sc.URL)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		j.SetCookies(u, []*http.Cookie{sc.Cookie})
+	}
+
+	j.mu.Lock()
+	j.changed = false
+	j.mu.Unlock()
+}
+
+// the saved cookies and whether any of them changed since the last call
+func (j *recording_jar) snapshot() ([]saved_cookie, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	keys := make([]string, 0, len(j.cookies))
+	for k := range j.cookies {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	saved := make([]saved_cookie, 0, len(keys))
+	for _, k := range keys {
+		saved = append(saved, j.cookies[k])
+	}
+	changed := j.changed
+	j.changed = false
+	return saved, changed
+}
+
+// cookies are the same cookie when domain, path and name match (RFC 6265 5.3). no Domain means host only
+func cookie_key(u *url.URL, c *http.Cookie) string {
+	domain := strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+	if domain == "" {
+		domain = "host:" + strings.ToLower(u.Hostname())
+	}
+	path := c.Path
+	if path == "" || !strings.HasPrefix(path, "/") {
+		// the default path is the request path up to its last slash
+		path = "/"
+		if i := strings.LastIndex(u.Path, "/"); i > 0 {
+			path = u.Path[:i]
+		}
+	}
+	return domain + ";" + path + ";" + c.Name
+}
+
+func same_cookie(a *http.Cookie, b *http.Cookie) bool {
+	expiry := a.Expires.Sub(b.Expires)
+	return a.Value == b.Value && a.Domain == b.Domain && a.Path == b.Path &&
+		a.Secure == b.Secure && a.HttpOnly == b.HttpOnly && a.SameSite == b.SameSite &&
+		a.Expires.IsZero() == b.Expires.IsZero() && expiry < expiry_slack && expiry > -expiry_slack
+}
+
+type Session_store struct {
+	mu       sync.Mutex
+	path     string
+	sessions map[string]*Browser_session
+	saved    map[string]saved_session
+}
+
+// path is where cookies are persisted between runs, empty keeps them in memory only
+func New_session_store(path string) (*Session_store, error) {
+	s := &Session_store{
+		path:     path,
+		sessions: make(map[string]*Browser_session),
+		saved:    make(map[string]saved_session),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading sessions file: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.saved); err != nil {
+		return nil, fmt.Errorf("parsing sessions file %s: %w", path, err)
+	}
+
+	for host, saved := range s.saved {
+		if time.Since(saved.Started) > session_max_age {
+			delete(s.saved, host)
+			continue
+		}
+
+		profile, ok := profile_by_name(saved.Profile)
+		if !ok {
+			delete(s.saved, host)
+			continue
+		}
+
+		sess := new_session(profile, saved.Started)
+		sess.jar.restore(saved.Cookies)
+		s.sessions[host] = sess
+	}
+
+	return s, nil
+}
+
+func new_session(profile Header_profile, started time.Time) *Browser_session {
+	jar := new_recording_jar()
+	return &Browser_session{Profile: profile, Jar: jar, jar: jar, started: started}
+}
+
+func profile_by_name(name string) (Header_profile, bool) {
+	for _, p := range Header_profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Header_profile{}, false
+}
+
+// returns the current session for host, starting a new one with a random profile if needed
+func (s *Session_store) Get(host string) *Browser_session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[host]; ok && time.Since(sess.started) < session_max_age {
+		return sess
+	}
+
+	sess := new_session(Header_profiles[rand.Intn(len(Header_profiles))], time.Now())
+	s.sessions[host] = sess
+	return sess
+}
+
+// throws away the session for host (used when it gets blocked) so the next scrape looks like a new visitor
+func (s *Session_store) Reset(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, host)
+	delete(s.saved, host)
+	return s.write()
+}
+
+// remembers the cookies the host handed back, the file is only rewritten when they (or the session) changed
+func (s *Session_store) Save(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[host]
+	if !ok {
+		return nil
+	}
+
+	cookies, changed := sess.jar.snapshot()
+	if prev, ok := s.saved[host]; ok && !changed && prev.Profile == sess.Profile.Name && prev.Started.Equal(sess.started) {
+		return nil
+	}
+
+	s.saved[host] = saved_session{
+		Profile: sess.Profile.Name,
+		Started: sess.started,
+		Cookies: cookies,
+	}
+	if err := s.write(); err != nil {
+		// try again on the next save
+		sess.jar.mu.Lock()
+		sess.jar.changed = true
+		sess.jar.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *Session_store) write() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal sessions: %w", err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("writing sessions file: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
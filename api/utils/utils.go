@@ -1,19 +1,23 @@
 package utils
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"regexp"
 	"strings"
 	"time"
 
-	browser "github.com/EDDYCJY/fake-useragent"
+	cache "github.com/anthonybliss1/go-apts/internal/cache"
+	health "github.com/anthonybliss1/go-apts/internal/health"
+	limiter "github.com/anthonybliss1/go-apts/internal/limiter"
+	store "github.com/anthonybliss1/go-apts/internal/store"
 )
 
 type Apartments struct {
@@ -24,35 +28,82 @@ type Apartments struct {
 	SquareFeet        float64
 	Rent              float64
 	AvailableDateText string
+	FloorPlanURL      string // floor plan image from the rentals blob, empty when there isn't one
+}
+
+// what a single scrape of a listing produced, this is what gets cached
+type Scrape_result struct {
+	Records     []Apartments
+	ListingName string
+	Photos      []string // building photos, og:image first
 }
 
 // defining regex pattern to find the rental section in the body of the response (same pattern from python project proved reliable)
 var Pattern = regexp.MustCompile(`rentals:\s*(\[.*?\])\s*,\s*disableMediaCascading`)
 var Listing_pattern = regexp.MustCompile(`listingName:\s*'([^']+)'`)
 
-func Create_proxies() (*http.Client, error) {
-	// store env variables to build proxy url
-	oxy_name := os.Getenv("OXYLABS_USERNAME")
+// every outbound scrape (/apts, /chat, cron) waits on this per-host limiter. main swaps in the configured one at startup
+var Scrape_limiter = limiter.New(limiter.Default_config())
+
+// browser sessions (header profile + cookies) per host. main swaps in a persisted store
+var Sessions, _ = New_session_store("")
+
+// per-provider parse stats, used to spot when a provider changes its markup. main swaps in one backed by the store
+var Parse_health = health.New_monitor(store.Memory(), nil)
+
+// cancelled once go-apts starts shutting down, main swaps in its signal context. scrapes still queued on the
+// rate limiter give up then instead of holding up the shutdown, ones already fetching finish
+var Stopping = context.Background()
+
+// scrape results keyed by canonical URL, so watches / cron jobs / API callers asking for the same listing share one fetch
+var Scrape_cache = cache.New[Scrape_result](5 * time.Minute)
+
+// normalises a listing URL so trivially different spellings hit the same cache entry
+// (host case, trailing slash, fragment, query param order)
+func Canonical_url(raw_url string) string {
+	parsed, err := url.Parse(strings.TrimSpace(raw_url))
+	if err != nil {
+		return raw_url
+	}
+
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+	parsed.Fragment = ""
+	parsed.RawFragment = ""
+	if len(parsed.Path) > 1 {
+		parsed.Path = strings.TrimRight(parsed.Path, "/")
+		parsed.RawPath = ""
+	}
+	parsed.RawQuery = parsed.Query().Encode()
+
+	return parsed.String()
+}
+
+// same as Scrape_listing but goes through Scrape_cache. force skips the cached copy (Cache-Control: no-cache)
+func Scrape_listing_cached(ctx context.Context, raw_url string, client *http.Client, force bool) (Scrape_result, cache.Status, error) {
+	return Scrape_cache.Get_or_fetch(ctx, Canonical_url(raw_url), force, func(fetch_ctx context.Context) (Scrape_result, error) {
+		return Scrape_listing(fetch_ctx, raw_url, client)
+	})
+}
+
+func Create_proxies(oxy_name string, oxy_pass string, oxy_proxy_host string, oxy_proxy_port string) (*http.Client, error) {
 	if oxy_name == "" {
 		return nil, fmt.Errorf("oxy username not set")
 	}
 
-	oxy_pass := os.Getenv("OXYLABS_PASSWORD")
 	if oxy_pass == "" {
 		return nil, fmt.Errorf("oxy pass not set")
 	}
 
-	oxy_proxy_host := os.Getenv("OXYLABS_PROXY_HOST")
 	if oxy_proxy_host == "" {
 		return nil, fmt.Errorf("oxy host not set")
 	}
 
-	oxy_proxy_port := os.Getenv("OXYLABS_PROXY_PORT")
 	if oxy_proxy_port == "" {
 		return nil, fmt.Errorf("oxy port not set")
 	}
 
-	// build the proxy_url using the env variables
+	// build the proxy_url from the proxies section of the config
 	proxy_string := fmt.Sprintf("http://%s:%s@%s:%s", oxy_name, oxy_pass, oxy_proxy_host, oxy_proxy_port)
 	proxy_url, err := url.Parse(proxy_string)
 	if err != nil {
@@ -82,177 +133,155 @@ func Create_proxies() (*http.Client, error) {
 	return client, nil
 }
 
-func Create_telegram_vars() (string, string, error) {
-	// setup telegram variables and chat notis
-	telegram_bot_token := os.Getenv("TELEGRAM_BOT_TOKEN")
-	if telegram_bot_token == "" {
-		return "", "", fmt.Errorf("telegram bot token not set")
-	}
-
-	telegram_chat_id := os.Getenv("TELEGRAM_CHAT_ID")
-	if telegram_chat_id == "" {
-		return "", "", fmt.Errorf("telegram chat id not set")
-	}
-
-	// build api url
-	telegram_api_url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", telegram_bot_token)
-
-	return telegram_api_url, telegram_chat_id, nil
+// TODO: need to add choice to use proxy or not. Fixed proxy latency but maybe still add the option if user doesn't have oxylabs account
+// Scrape_apartment_listing returns the available units and the listing name
+func Scrape_apartment_listing(ctx context.Context, raw_url string, client *http.Client) ([]Apartments, string, error) {
+	result, err := Scrape_listing(ctx, raw_url, client)
+	return result.Records, result.ListingName, err
 }
 
-// TODO: need to add choice to use proxy or not. Fixed proxy latency but maybe still add the option if user doesn't have oxylabs account
-func Scrape_apartment_listing(raw_url string, client *http.Client) ([]Apartments, string, error) {
+// Scrape_listing fetches and parses one listing page, including its photos. ctx is the caller's (the request,
+// or a watch run), the fetch is given up when it's done
+func Scrape_listing(ctx context.Context, raw_url string, client *http.Client) (Scrape_result, error) {
 	parsedURL, err := url.Parse(raw_url)
 	if err != nil {
-		return nil, "", fmt.Errorf("invalid URL: %w", err)
+		return Scrape_result{}, New_error(ErrInvalidURL, "", err)
 	}
 
 	host := parsedURL.Host
 
 	// establishing the GET request to pull rental data from url
-	req, err := http.NewRequest("GET", raw_url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", raw_url, nil)
 	if err != nil {
-		return nil, "", fmt.Errorf("building request: %w", err)
+		return Scrape_result{}, fmt.Errorf("building request: %w", err)
 	}
 
 	if host == "www.apartments.com" {
-		// defining headers (same as python version)
-		req.Header.Add("authority", "www.apartments.com")
-		req.Header.Add("accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7")
-		req.Header.Add("accept-language", "en-US,en;q=0.9")
-		req.Header.Add("cache-control", "no-cache")
-		req.Header.Add("dnt", "1")
-		req.Header.Add("pragma", "no-cache")
-		req.Header.Add("Sec-CH-UA", `"Not A(Brand";v="8", "Chromium";v="132"`)
-		req.Header.Add("sec-ch-ua-mobile", "?0")
-		req.Header.Add("sec-ch-ua-platform", "macOS")
-		req.Header.Add("sec-fetch-dest", "document")
-		req.Header.Add("sec-fetch-mode", "navigate")
-		req.Header.Add("sec-fetch-site", "none")
-		req.Header.Add("sec-fetch-user", "?1")
-		req.Header.Add("upgrade-insecure-requests", "1")
-		// fake user agent generated for Chrome
-		req.Header.Add("user-agent", browser.Chrome())
+		// headers come from this host's session profile so UA, client hints and platform always agree
+		sess := Sessions.Get(host)
+		req.Header.Set("authority", host)
+		req.Header.Set("dnt", "1")
+		sess.Profile.Apply(req)
+
+		// wait our turn for this host so bursts of requests don't get the IP blocked
+		if err := wait_turn(ctx, host); err != nil {
+			return Scrape_result{}, err
+		}
 
 		// drop dead sockets (if idle)
 		if tr, ok := client.Transport.(*http.Transport); ok {
 			tr.CloseIdleConnections()
 		}
 
-		resp, err := client.Do(req)
+		// same transport, but with the session's cookie jar so repeat visits look like the same browser
+		session_client := *client
+		session_client.Jar = sess.Jar
+
+		resp, err := session_client.Do(req)
 		if err != nil {
-			return nil, "", fmt.Errorf("sending HTTP request to apartments.com failed: %w", err)
+			return Scrape_result{}, request_error("sending HTTP request to apartments.com failed", err)
 		}
 
 		defer resp.Body.Close()
 
+		if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests {
+			// this identity is burned, start over with a new profile and empty jar next time
+			if err := Sessions.Reset(host); err != nil {
+				log.Printf("resetting session for %s: %v\n", host, err)
+			}
+		} else if err := Sessions.Save(host); err != nil {
+			log.Printf("saving session for %s: %v\n", host, err)
+		}
+
 		if resp.StatusCode != http.StatusOK {
-			return nil, "", fmt.Errorf("received status %d from apartments.com", resp.StatusCode)
+			return Scrape_result{}, status_error(host, resp.StatusCode)
 		}
 
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return nil, "", fmt.Errorf("reading response body: %w", err)
+			return Scrape_result{}, request_error("reading response body", err)
 		}
 
 		body_string := string(body)
 
-		// if we find the rentals
-		if match := Pattern.FindStringSubmatch(body_string); len(match) > 1 {
-			var a []Apartments
-			var listing_name string
+		canonical := Canonical_url(raw_url)
 
-			if listing_match := Listing_pattern.FindStringSubmatch(body_string); len(listing_match) > 1 {
-				listing_name = listing_match[1]
-			}
+		// a 200 with no rentals blob means the markup changed, not that the building is empty
+		match := Pattern.FindStringSubmatch(body_string)
+		if len(match) < 2 {
+			Parse_health.Record_failure(host, canonical, health.MissingBlob, "rentals blob not found in page")
+			return Scrape_result{}, New_error(ErrParse, "rentals blob not found in page, the listing markup may have changed", nil)
+		}
 
-			Data := []byte(match[1])
+		var a []Apartments
+		var listing_name string
 
-			err := json.Unmarshal(Data, &a)
-			if err != nil {
-				return nil, "", fmt.Errorf("parsing json: %w", err)
-			}
+		if listing_match := Listing_pattern.FindStringSubmatch(body_string); len(listing_match) > 1 {
+			listing_name = listing_match[1]
+		}
 
-			// if the listing in one 'room' then we print it regardless (it likely is a home for rent with no Name or Unit)
-			if len(a) == 1 {
-				return a, "", nil
-			}
+		Data := []byte(match[1])
 
-			// for now, printing out our rentals that have an availability date
-			var records []Apartments
-			for _, apt := range a {
-				if apt.AvailableDateText != "Available Soon" && apt.UnitNumber != "" {
-					records = append(records, apt)
-				}
-			}
-			return records, listing_name, nil
+		missing, err := check_rentals_schema(Data)
+		if err != nil {
+			Parse_health.Record_failure(host, canonical, health.BadJSON, err.Error())
+			return Scrape_result{}, New_error(ErrParse, "parsing rentals json", err)
+		}
+		if len(missing) > 0 {
+			Parse_health.Record_warning(host, canonical, health.SchemaChange, "rentals are missing fields: "+strings.Join(missing, ", "))
 		}
 
-	} else if host == "www.zillow.com" {
-		fmt.Println("\nDEBUG: Sending request for zillow")
-	} else {
-		return nil, "", fmt.Errorf("unsupported host")
-	}
-	return []Apartments{}, "", nil
-}
+		if err := json.Unmarshal(Data, &a); err != nil {
+			Parse_health.Record_failure(host, canonical, health.BadJSON, err.Error())
+			return Scrape_result{}, New_error(ErrParse, "parsing rentals json", err)
+		}
 
-func Send_notification(raw_url string, client *http.Client) error {
+		// images are a nice to have, a page without them still scraped fine
+		attach_floor_plans(Data, a)
+		photos := listing_photos(body_string, max_listing_photos)
 
-	api_url, chat_id, err := Create_telegram_vars()
-	if err != nil {
-		return err
-	}
+		Parse_health.Record_success(host, canonical, len(a))
 
-	records, listing_name, err := Scrape_apartment_listing(raw_url, client)
-	if err != nil {
-		return err
-	}
+		// if the listing in one 'room' then we print it regardless (it likely is a home for rent with no Name or Unit)
+		if len(a) == 1 {
+			return Scrape_result{Records: a, Photos: photos}, nil
+		}
 
-	var data []string
-	for _, apt := range records {
-		line := fmt.Sprintf("🏠 Unit: %s\n🛏️ %d Bed | 🛁 %.1f Bath\n💰 $%.2f | 📏 %.0f sqft\n🗓️ %s", apt.Name, apt.Beds, apt.Baths, apt.Rent, apt.SquareFeet, apt.AvailableDateText)
-		data = append(data, line)
-	}
+		// for now, printing out our rentals that have an availability date
+		var records []Apartments
+		for _, apt := range a {
+			if apt.AvailableDateText != "Available Soon" && apt.UnitNumber != "" {
+				records = append(records, apt)
+			}
+		}
+		return Scrape_result{Records: records, ListingName: listing_name, Photos: photos}, nil
 
-	var msg_body string
-	var full_message string
-	if len(data) > 0 {
-		msg_body = strings.Join(data, "\n━━━━━━━━━━━━━━━━━\n")
-		full_message = fmt.Sprintf("\n🚨 %s Alert 🚨\n\n%s\n", listing_name, msg_body)
+	} else if host == "www.zillow.com" {
+		fmt.Println("\nDEBUG: Sending request for zillow")
 	} else {
-		full_message = fmt.Sprintf("No available units right now at %s", listing_name)
-	}
-
-	// define our payload which requires the chat_id and a message
-	payload := map[string]string{
-		"chat_id": chat_id,
-		"text":    full_message,
-	}
-
-	// marshal the payload to []byte type
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("marshal telegram payload: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", api_url, bytes.NewReader(body))
-	if err != nil {
-		return fmt.Errorf("building telegram request: %q", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	t_client := &http.Client{}
-
-	resp, err := t_client.Do(req)
-	if err != nil {
-		return fmt.Errorf("send telegram request: %q", err)
+		return Scrape_result{}, New_error(ErrUnsupportedHost, host, nil)
 	}
-	defer resp.Body.Close()
+	return Scrape_result{Records: []Apartments{}}, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("received status code %d from telegram", resp.StatusCode)
+// wait_turn waits on Scrape_limiter for host until ctx is done or go-apts starts shutting down
+func wait_turn(ctx context.Context, host string) error {
+	wait_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(Stopping, cancel)
+	defer stop()
+
+	err := Scrape_limiter.Wait(wait_ctx, host)
+	switch {
+	case err == nil:
+		return nil
+	case Stopping.Err() != nil && ctx.Err() == nil:
+		return New_error(ErrShuttingDown, "the scrape was still queued for "+host, nil)
+	case errors.Is(err, limiter.ErrQueueFull), errors.Is(err, limiter.ErrMaxWait):
+		return New_error(ErrRateLimited, "", err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return New_error(ErrTimeout, "the scrape was still queued for "+host, err)
 	}
-
-	return nil
+	// a canceled ctx means whoever asked has gone, the handlers know what to do with that
+	return err
 }
@@ -1,26 +1,41 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	handlers "github.com/anthonybliss1/go-apts/api/handlers"
 	utils "github.com/anthonybliss1/go-apts/api/utils"
+	bot "github.com/anthonybliss1/go-apts/internal/bot"
+	cache "github.com/anthonybliss1/go-apts/internal/cache"
+	config "github.com/anthonybliss1/go-apts/internal/config"
+	health "github.com/anthonybliss1/go-apts/internal/health"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+	limiter "github.com/anthonybliss1/go-apts/internal/limiter"
+	notify "github.com/anthonybliss1/go-apts/internal/notify"
+	rules "github.com/anthonybliss1/go-apts/internal/rules"
+	scheduler "github.com/anthonybliss1/go-apts/internal/scheduler"
 	setup "github.com/anthonybliss1/go-apts/internal/setup"
+	store "github.com/anthonybliss1/go-apts/internal/store"
+	subscribers "github.com/anthonybliss1/go-apts/internal/subscribers"
+	unitstate "github.com/anthonybliss1/go-apts/internal/unitstate"
+	watch "github.com/anthonybliss1/go-apts/internal/watch"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
 )
 
 func main() {
-	var proxies_enabled, telegram_enabled string
-
-	godotenv.Load(".env")
-
 	client := &http.Client{}
 
 	r := chi.NewRouter()
@@ -33,58 +48,315 @@ func main() {
   \/_____/   \/_____/      \/_/\/_/   \/_/       \/_/   \/_____/ `)
 
 	setup_mode := flag.Bool("setup", false, "Run interactive configuration and exit")
+	config_flag := flag.String("config", "", "YAML or TOML config file (default $"+config.Env_config+" or "+config.Default_path()+")")
 	flag.Parse()
 
-	oxy_name, _ := os.LookupEnv("OXYLABS_USERNAME")
-	oxy_pass, _ := os.LookupEnv("OXYLABS_PASSWORD")
-	oxy_host, _ := os.LookupEnv("OXYLABS_PROXY_HOST")
-	oxy_port, _ := os.LookupEnv("OXYLABS_PROXY_PORT")
-	telegram_bot_token := os.Getenv("TELEGRAM_BOT_TOKEN")
-	telegram_chat_id := os.Getenv("TELEGRAM_CHAT_ID")
-	proxies_enabled, _ = os.LookupEnv("proxies_enabled")
-	telegram_enabled, _ = os.LookupEnv("telegram_enabled")
+	config_path := *config_flag
+	if config_path == "" {
+		config_path = os.Getenv(config.Env_config)
+	}
+	if config_path == "" {
+		config_path = config.Default_path()
+	}
 
-	switch {
-	case oxy_name == "" || oxy_pass == "" || oxy_host == "" || oxy_port == "":
-		proxies_enabled = "n"
-	case telegram_bot_token == "" || telegram_chat_id == "":
-		telegram_enabled = "n"
+	// .env files still work on top of the config: the one --setup writes next to it, then one in the working directory
+	godotenv.Load(config.Env_path(config_path))
+	godotenv.Load(".env")
+
+	// --setup is how a broken or half written config gets fixed, so it only has to load
+	cfg, err := config.Load(config_path)
+	if err != nil && !*setup_mode {
+		log.Fatalf("config %s:\n%v", config_path, err)
+	}
+
+	st, err := store.Open(cfg.Storage.Store)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	if *setup_mode {
-		err := setup.Setup_go_apts()
-		if err != nil {
+		if err := setup.Setup_go_apts(st, cfg, config_path); err != nil {
 			log.Fatal(err)
 		}
 
-		proxies_enabled, _ = os.LookupEnv("proxies_enabled")
-		telegram_enabled, _ = os.LookupEnv("telegram_enabled")
+		// pick up what setup saved
+		if cfg, err = config.Load(config_path); err != nil {
+			log.Fatalf("config %s:\n%v", config_path, err)
+		}
+	}
+
+	utils.Scrape_limiter = limiter.New(cfg.Providers.RateLimit.Limiter())
+	utils.Scrape_cache = cache.New[utils.Scrape_result](cfg.Storage.CacheTTL.Std())
+
+	utils.Sessions, err = utils.New_session_store(cfg.Storage.Sessions)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	switch {
-	case strings.EqualFold(proxies_enabled, "y") && strings.EqualFold(telegram_enabled, "y"):
-		proxy_client, err := utils.Create_proxies()
+	utils.Parse_health = health.New_monitor(st, notify.Operator_alert)
+	notify.Unit_history = history.New(st)
+	notify.Unit_states = unitstate.New(st)
+	notify.Digests = notify.New_digest_queue(st)
+	notify.Outgoing = notify.New_outbox_from_config(cfg.Notifiers.Outbox, st)
+	watches := watch.New(st)
+
+	// <channel>.tmpl / default.tmpl files replacing the built in alert text
+	notify.Template_dir = cfg.Notifiers.TemplateDir
+	notify.Default_channel_names = cfg.Notifiers.DefaultChannels
+	notify.Default_delivery = cfg.Notifiers.Delivery.For
+
+	r.Get("/health/parsers", handlers.Parser_health_handler())
+
+	mode := ""
+	if cfg.Proxies.Enabled {
+		client, err = utils.Create_proxies(cfg.Proxies.Username, cfg.Proxies.Password, cfg.Proxies.Host, cfg.Proxies.Port)
 		if err != nil {
 			log.Fatal(err)
 		}
-		r.Get("/apts", handlers.Scrape_handler(proxy_client))
-		r.Post("/chat", handlers.Chat_handler(proxy_client))
-		fmt.Println("\n<GO APTS> /apts and /chat with proxies running on port 8000")
-	case strings.EqualFold(proxies_enabled, "n") && strings.EqualFold(telegram_enabled, "y"):
-		r.Get("/apts", handlers.Scrape_handler(client))
-		r.Post("/chat", handlers.Chat_handler(client))
-		fmt.Println("\n<GO APTS> /apts and /chat running on port 8000")
-	case strings.EqualFold(proxies_enabled, "y") && strings.EqualFold(telegram_enabled, "n"):
-		proxy_client, err := utils.Create_proxies()
-		if err != nil {
-			log.Fatal(err)
+		mode = " with proxies"
+	}
+
+	// every configured channel goes in the registry, /chat and watches pick from it by name
+	n := cfg.Notifiers
+	var telegram *notify.Telegram
+	t, err := notify.New_telegram(n.Telegram)
+	if err == nil {
+		// operator alerts use the bot even when telegram isn't a channel
+		notify.Operator_bot = t
+		notify.Operator_chat_id = n.Operator.TelegramChatID
+	}
+	if register("telegram", n.Telegram.Enabled, t, err) {
+		telegram = t
+		// chats and forum topics picked in --setup or with /subscribe
+		telegram.Subscribers = subscribers.New(st)
+	}
+
+	slack, err := notify.New_slack(n.Slack)
+	register("slack", n.Slack.Enabled || n.Slack.WebhookURL != "", slack, err)
+
+	discord, err := notify.New_discord(n.Discord)
+	register("discord", n.Discord.Enabled || n.Discord.WebhookURL != "", discord, err)
+
+	email, err := notify.New_email(n.Email)
+	register("email", n.Email.Host != "", email, err)
+
+	ntfy, err := notify.New_ntfy(n.Ntfy)
+	register("ntfy", n.Ntfy.Enabled || n.Ntfy.Topic != "", ntfy, err)
+
+	gotify, err := notify.New_gotify(n.Gotify)
+	register("gotify", n.Gotify.URL != "", gotify, err)
+
+	matrix, err := notify.New_matrix(n.Matrix)
+	register("matrix", n.Matrix.Homeserver != "", matrix, err)
+
+	sms, err := notify.New_sms(n.Sms, st)
+	register("sms", n.Sms.AccountSID != "", sms, err)
+
+	mqtt, err := notify.New_mqtt(n.Mqtt)
+	register("mqtt", n.Mqtt.Broker != "", mqtt, err)
+
+	webhook, err := notify.New_webhook(n.Webhook, st)
+	if register("webhook", n.Webhook.Enabled || len(n.Webhook.URLs) > 0, webhook, err) {
+		r.Get("/webhooks/deliveries", handlers.Webhook_deliveries_handler())
+	}
+
+	if only := notify.Channels.Rule_only_channels(notify.Default_channels()); len(only) > 0 {
+		log.Fatalf("notifiers.default_channels: %s can only be used on high priority watch rules", only[0])
+	}
+
+	if err := seed_watches(cfg.Watches, watches); err != nil {
+		log.Fatalf("config %s:\n%v", config_path, err)
+	}
+
+	// SIGINT / SIGTERM (systemctl stop or restart) cancels stopping: the background loops below finish what
+	// they're doing and return, and the server stops taking requests
+	stopping, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	utils.Stopping = stopping
+
+	var background sync.WaitGroup
+	run := func(fn func(ctx context.Context)) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			fn(stopping)
+		}()
+	}
+
+	routes := []string{"/apts"}
+	r.Get("/apts", handlers.Scrape_handler(client))
+
+	if len(notify.Channels.Names()) > 0 {
+		r.Post("/chat", handlers.Chat_handler(client, watches))
+		r.Get("/watches", handlers.Watches_list_handler(watches))
+		r.Post("/watches", handlers.Watch_create_handler(watches))
+		r.Delete("/watches/{id}", handlers.Watch_delete_handler(watches))
+		r.Post("/templates/preview", handlers.Template_preview_handler(client, watches))
+		r.Get("/outbox", handlers.Outbox_list_handler())
+		r.Post("/outbox/replay", handlers.Outbox_replay_failed_handler())
+		r.Post("/outbox/{id}/replay", handlers.Outbox_replay_handler())
+		routes = append(routes, "/chat", "/watches", "/templates/preview", "/outbox")
+
+		// watches with an interval are run from here rather than by cron
+		run(scheduler.New(watches, client).Run)
+		// retries sends that failed, so an unreachable channel doesn't lose the alert
+		run(notify.Outgoing.Run)
+	}
+
+	// chat commands (/watch, /list, ...) either by long polling or a webhook telegram pushes to
+	var b *bot.Bot
+	if telegram != nil {
+		tg := cfg.Notifiers.Telegram
+		b = bot.New(telegram, watches, client, tg.AllowedChatIDs, tg.WebhookSecret)
+
+		switch tg.Commands {
+		case "poll":
+			run(b.Poll)
+		case "webhook":
+			r.Post("/telegram/webhook", handlers.Telegram_webhook_handler(b))
+			routes = append(routes, "/telegram/webhook")
+
+			if tg.WebhookURL != "" {
+				if err := b.Register_webhook(stopping, tg.WebhookURL); err != nil {
+					log.Printf("registering telegram webhook: %v\n", err)
+				}
+			}
 		}
-		r.Get("/apts", handlers.Scrape_handler(proxy_client))
-		fmt.Println("\n<GO APTS> /apts with proxies running on port 8000")
-	default:
-		r.Get("/apts", handlers.Scrape_handler(client))
-		fmt.Println("\n<GO APTS> /apts running on port 8000")
 	}
 
-	log.Fatal(http.ListenAndServe("0.0.0.0:8000", r))
+	fmt.Printf("\n<GO APTS> %s%s running on %s (channels: %v)\n", strings.Join(routes, " and "), mode, cfg.Server.Listen, notify.Channels.Names())
+
+	server := &http.Server{
+		Addr:              cfg.Server.Listen,
+		Handler:           r,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout.Std(),
+		ReadTimeout:       cfg.Server.ReadTimeout.Std(),
+		WriteTimeout:      cfg.Server.WriteTimeout.Std(),
+		IdleTimeout:       cfg.Server.IdleTimeout.Std(),
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+	}
+
+	// a server that can't start (port taken) goes through the same shutdown, so the store is still written
+	serve_err := make(chan error, 1)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serve_err <- err
+		}
+	}()
+
+	exit_code := 0
+	select {
+	case <-stopping.Done():
+	case err := <-serve_err:
+		log.Printf("http server: %v\n", err)
+		exit_code = 1
+	}
+	// a second ctrl-c kills it straight away, and the background loops see the stop in both cases
+	stop()
+
+	timeout := cfg.Server.ShutdownTimeout.Std()
+	log.Printf("shutting down, giving running scrapes and sends up to %s\n", timeout)
+
+	shutdown_ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	shut_down(shutdown_ctx, server, &background, b)
+	cancel()
+
+	// whatever didn't finish is still pending in the store (outbox entries, watches not marked as run)
+	// and is picked up again on the next start
+	if err := st.Close(); err != nil {
+		log.Printf("closing store: %v\n", err)
+	}
+	log.Println("stopped")
+	if exit_code != 0 {
+		os.Exit(exit_code)
+	}
+}
+
+// register adds a channel the config turns on. a constructor error then stops startup, a channel that's
+// configured but quietly missing from the registry only shows up when an alert never arrives
+func register(name string, enabled bool, channel notify.Notifier, err error) bool {
+	if !enabled {
+		return false
+	}
+	if err != nil {
+		log.Fatalf("notifiers.%s: %v", name, err)
+	}
+	notify.Channels.Register(channel)
+	return true
+}
+
+// shut_down waits for requests in flight, the background loops and bot commands, until ctx runs out
+func shut_down(ctx context.Context, server *http.Server, background *sync.WaitGroup, b *bot.Bot) {
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("http server: %v, closing the connections left\n", err)
+		server.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		if b != nil {
+			b.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("shutdown timeout reached, not waiting for the rest")
+	}
+}
+
+// seed_watches saves the watches from the config file under their own ids, so editing the file and
+// restarting updates them. runs, pauses and the chat a watch belongs to are kept from the store
+func seed_watches(configured []config.Watch, watches *watch.Watches) error {
+	for i, cw := range configured {
+		field := fmt.Sprintf("watches[%d]", i)
+		wt := cw.Watch()
+
+		if len(wt.Channels) == 0 {
+			wt.Channels = notify.Default_channels()
+		}
+		if _, err := notify.Channels.Resolve(wt.Channels); err != nil {
+			return fmt.Errorf("%s.channels: %w", field, err)
+		}
+		if only := notify.Channels.Rule_only_channels(wt.Channels); len(only) > 0 {
+			return fmt.Errorf("%s.channels: %s can only be used on a high priority rule, not on the watch", field, only[0])
+		}
+
+		for channel, text := range wt.Templates {
+			if _, err := notify.Parse_template(text); err != nil {
+				return fmt.Errorf("%s.templates.%s: %w", field, channel, err)
+			}
+		}
+
+		for j, rule := range wt.Rules {
+			if _, err := notify.Channels.Resolve(rule.Channels); err != nil {
+				return fmt.Errorf("%s.rules[%d].channels: %w", field, j, err)
+			}
+			if only := notify.Channels.Rule_only_channels(rule.Channels); len(only) > 0 && rule.Priority_name() != rules.Priority_high {
+				return fmt.Errorf("%s.rules[%d].channels: %s needs priority high, got %q", field, j, only[0], rule.Priority)
+			}
+		}
+
+		existing, found, err := watches.Get(wt.ID)
+		if err != nil {
+			return err
+		}
+		if found {
+			wt.CreatedAt = existing.CreatedAt
+			wt.Paused = existing.Paused
+			wt.ChatID = existing.ChatID
+			wt.LastRun = existing.LastRun
+			wt.LastError = existing.LastError
+		} else {
+			wt.CreatedAt = time.Now()
+		}
+
+		if err := watches.Save(wt); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,388 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	notify "github.com/anthonybliss1/go-apts/internal/notify"
+	subscribers "github.com/anthonybliss1/go-apts/internal/subscribers"
+	watch "github.com/anthonybliss1/go-apts/internal/watch"
+)
+
+const poll_timeout = 30 * time.Second
+
+const help_text = `<b>go-apts commands</b>
+/watch &lt;url&gt; [hourly|daily|weekly] - monitor a listing (hourly by default)
+/list - watches in this chat
+/unwatch &lt;id&gt; - stop a watch
+/check &lt;url&gt; - scrape a listing right now
+/pause [id] - pause every watch in this chat, or just one
+/resume [id] - start them again
+/subscribe &lt;id|all&gt; - get alerts for another watch here
+/unsubscribe &lt;id|all&gt; - stop getting them`
+
+// Bot answers chat commands so watches can be managed without SSH-ing in to run --setup
+type Bot struct {
+	Telegram *notify.Telegram
+	Watches  *watch.Watches
+	Client   *http.Client    // scrape client for /check and watch runs
+	Allowed  map[string]bool // chat ids allowed to send commands, registered subscribers are allowed too
+	Secret   string          // checked against X-Telegram-Bot-Api-Secret-Token in webhook mode
+
+	running sync.WaitGroup // commands answered in the background, see Go
+}
+
+// allowed chats come from allowed_chat_ids, falling back to the telegram chat_id
+func New(t *notify.Telegram, watches *watch.Watches, client *http.Client, allowed_ids []string, secret string) *Bot {
+	allowed := make(map[string]bool)
+	for _, id := range allowed_ids {
+		if id = strings.TrimSpace(id); id != "" {
+			allowed[id] = true
+		}
+	}
+	if len(allowed) == 0 {
+		allowed[t.ChatID] = true
+	}
+
+	return &Bot{
+		Telegram: t,
+		Watches:  watches,
+		Client:   client,
+		Allowed:  allowed,
+		Secret:   secret,
+	}
+}
+
+// Poll long polls getUpdates until ctx is done
+func (b *Bot) Poll(ctx context.Context) {
+	// getUpdates is refused while a webhook is set
+	if err := b.Telegram.Call(ctx, "deleteWebhook", map[string]any{}, nil); err != nil {
+		log.Printf("bot: deleting webhook: %v\n", err)
+	}
+
+	offset := 0
+	for ctx.Err() == nil {
+		updates, err := b.Telegram.Get_updates(ctx, offset, poll_timeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("bot: getUpdates: %v\n", err)
+			sleep(ctx, 5*time.Second)
+			continue
+		}
+
+		// a command that came in just before shutdown still gets its answer
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			b.Handle(context.WithoutCancel(ctx), u)
+		}
+	}
+}
+
+// Go runs fn in the background, Wait waits for everything started this way (main does on shutdown)
+func (b *Bot) Go(fn func()) {
+	b.running.Add(1)
+	go func() {
+		defer b.running.Done()
+		fn()
+	}()
+}
+
+func (b *Bot) Wait() {
+	b.running.Wait()
+}
+
+// Register_webhook points telegram at public_url for updates instead of polling
+func (b *Bot) Register_webhook(ctx context.Context, public_url string) error {
+	payload := map[string]any{
+		"url":             public_url,
+		"allowed_updates": []string{"message", "channel_post", "callback_query"},
+	}
+	if b.Secret != "" {
+		payload["secret_token"] = b.Secret
+	}
+	return b.Telegram.Call(ctx, "setWebhook", payload, nil)
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// Handle runs one update, replies go back to the chat (and topic) the command came from
+func (b *Bot) Handle(ctx context.Context, u notify.Update) {
+	if u.CallbackQuery != nil {
+		b.callback(ctx, u.CallbackQuery)
+		return
+	}
+
+	msg := u.Message
+	if msg == nil {
+		msg = u.ChannelPost
+	}
+	if msg == nil || !strings.HasPrefix(msg.Text, "/") {
+		return
+	}
+
+	chat_id := strconv.FormatInt(msg.Chat.ID, 10)
+	if !b.allowed(chat_id) {
+		log.Printf("bot: ignoring command from unauthorised chat %s\n", chat_id)
+		b.reply(ctx, msg, "⛔ This chat isn't allowed to control go-apts.")
+		return
+	}
+
+	fields := strings.Fields(msg.Text)
+	// in groups commands come as /watch@botname
+	command, _, _ := strings.Cut(strings.ToLower(fields[0]), "@")
+	args := fields[1:]
+
+	// commands sent in a forum topic manage that topic's alerts
+	target := subscribers.Target_key(chat_id, msg.MessageThreadID)
+
+	var reply string
+	var err error
+	switch command {
+	case "/watch":
+		reply, err = b.watch(chat_id, target, args)
+	case "/list":
+		reply, err = b.list(chat_id)
+	case "/unwatch":
+		reply, err = b.unwatch(chat_id, args)
+	case "/check":
+		// a scrape can sit in the rate limit queue for a while, don't hold up other commands
+		b.Go(func() {
+			if err := b.check(ctx, target, args); err != nil {
+				b.reply(ctx, msg, "⚠️ "+html.EscapeString(err.Error()))
+			}
+		})
+	case "/pause":
+		reply, err = b.set_paused(chat_id, args, true)
+	case "/resume":
+		reply, err = b.set_paused(chat_id, args, false)
+	case "/subscribe":
+		reply, err = b.subscribe(msg, args, true)
+	case "/unsubscribe":
+		reply, err = b.subscribe(msg, args, false)
+	case "/start", "/help":
+		reply = help_text
+	default:
+		reply = "I don't know that command.\n\n" + help_text
+	}
+
+	if err != nil {
+		reply = "⚠️ " + html.EscapeString(err.Error())
+	}
+	if reply != "" {
+		b.reply(ctx, msg, reply)
+	}
+}
+
+func (b *Bot) allowed(chat_id string) bool {
+	return b.Allowed[chat_id] || b.Telegram.Subscribers != nil && b.Telegram.Subscribers.Has_chat(chat_id)
+}
+
+func (b *Bot) reply(ctx context.Context, msg *notify.Telegram_incoming, text string) {
+	chat_id := strconv.FormatInt(msg.Chat.ID, 10)
+	if err := b.Telegram.Reply(ctx, chat_id, msg.MessageThreadID, text); err != nil {
+		log.Printf("bot: replying to %s: %v\n", chat_id, err)
+	}
+}
+
+func listing_url(raw string) (string, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return "", fmt.Errorf("%q doesn't look like a listing URL", raw)
+	}
+	return raw, nil
+}
+
+func (b *Bot) watch(chat_id string, target string, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("usage: /watch <url> [hourly|daily|weekly]")
+	}
+
+	raw_url, err := listing_url(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	interval := "hourly"
+	if len(args) > 1 {
+		interval = strings.ToLower(args[1])
+	}
+	if interval == "" || !watch.Valid_interval(interval) {
+		return "", fmt.Errorf("interval must be hourly, daily or weekly, got %q", interval)
+	}
+
+	wt, err := b.Watches.Add(watch.Watch{
+		URL:      raw_url,
+		Channels: []string{"telegram"},
+		Targets:  map[string]string{"telegram": target},
+		Interval: interval,
+		ChatID:   chat_id,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("👀 Watching %s %s\nid: <code>%s</code>", html.EscapeString(raw_url), interval, wt.ID), nil
+}
+
+// watches created in or sending to chat_id (any topic)
+func (b *Bot) chat_watches(chat_id string) ([]watch.Watch, error) {
+	all, err := b.Watches.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var mine []watch.Watch
+	for _, wt := range all {
+		if wt.ChatID == chat_id || targets_chat(wt.Targets["telegram"], chat_id) {
+			mine = append(mine, wt)
+		}
+	}
+	return mine, nil
+}
+
+func targets_chat(targets string, chat_id string) bool {
+	for _, target := range strings.Split(targets, ",") {
+		if id, _, err := subscribers.Parse_target(target); err == nil && id == chat_id {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bot) list(chat_id string) (string, error) {
+	mine, err := b.chat_watches(chat_id)
+	if err != nil {
+		return "", err
+	}
+	subscribed, err := b.subscribed_watches(chat_id, mine)
+	if err != nil {
+		return "", err
+	}
+	if len(mine) == 0 && len(subscribed) == 0 {
+		return "No watches in this chat yet. Add one with /watch &lt;url&gt;", nil
+	}
+
+	lines := []string{"<b>Watches</b>"}
+	for _, wt := range append(mine, subscribed...) {
+		status := wt.Interval
+		if status == "" {
+			status = "on demand"
+		}
+		if wt.Paused {
+			status += ", paused"
+		}
+		if wt.LastError != "" {
+			status += ", last run failed"
+		}
+		if slices.ContainsFunc(subscribed, func(s watch.Watch) bool { return s.ID == wt.ID }) {
+			status += ", subscribed"
+		}
+		lines = append(lines, fmt.Sprintf("<code>%s</code> (%s)\n%s", wt.ID, status, html.EscapeString(wt.URL)))
+	}
+	return strings.Join(lines, "\n\n"), nil
+}
+
+// finds id among this chat's watches, so one chat can't touch another's
+func (b *Bot) chat_watch(chat_id string, id string) (watch.Watch, error) {
+	mine, err := b.chat_watches(chat_id)
+	if err != nil {
+		return watch.Watch{}, err
+	}
+	for _, wt := range mine {
+		if wt.ID == id {
+			return wt, nil
+		}
+	}
+	return watch.Watch{}, fmt.Errorf("no watch %q in this chat, see /list", id)
+}
+
+func (b *Bot) unwatch(chat_id string, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("usage: /unwatch <id>")
+	}
+
+	wt, err := b.chat_watch(chat_id, args[0])
+	if err != nil {
+		return "", err
+	}
+	if err := b.Watches.Remove(wt.ID); err != nil {
+		return "", err
+	}
+	if err := notify.Unit_history.Forget(wt.ID); err != nil {
+		log.Printf("removing history of watch %s: %v\n", wt.ID, err)
+	}
+	return fmt.Sprintf("🗑️ Stopped watching %s", html.EscapeString(wt.URL)), nil
+}
+
+func (b *Bot) set_paused(chat_id string, args []string, paused bool) (string, error) {
+	var targets []watch.Watch
+	if len(args) > 0 {
+		wt, err := b.chat_watch(chat_id, args[0])
+		if err != nil {
+			return "", err
+		}
+		targets = []watch.Watch{wt}
+	} else {
+		mine, err := b.chat_watches(chat_id)
+		if err != nil {
+			return "", err
+		}
+		targets = mine
+	}
+
+	for _, wt := range targets {
+		wt.Paused = paused
+		if err := b.Watches.Save(wt); err != nil {
+			return "", err
+		}
+	}
+
+	verb := "⏸️ Paused"
+	if !paused {
+		verb = "▶️ Resumed"
+	}
+	return fmt.Sprintf("%s %d watch(es)", verb, len(targets)), nil
+}
+
+// scrapes now and sends the alert to this chat (and topic) only
+func (b *Bot) check(ctx context.Context, target string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: /check <url>")
+	}
+
+	raw_url, err := listing_url(args[0])
+	if err != nil {
+		return err
+	}
+
+	alert, err := notify.Build_alert(ctx, raw_url, b.Client, true, "")
+	if err != nil {
+		return err
+	}
+	alert.Targets = map[string]string{"telegram": target}
+
+	// a one-off check goes where it was asked for, not to every subscriber
+	only_here := *b.Telegram
+	only_here.Subscribers = nil
+	return only_here.Send(ctx, alert)
+}
@@ -0,0 +1,79 @@
+package bot
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	notify "github.com/anthonybliss1/go-apts/internal/notify"
+	unitstate "github.com/anthonybliss1/go-apts/internal/unitstate"
+)
+
+const snooze_for = 7 * 24 * time.Hour
+
+// callback handles the buttons under an alert: action:listing_id[:unit_id]
+func (b *Bot) callback(ctx context.Context, cq *notify.Callback_query) {
+	if cq.Message == nil || !b.allowed(strconv.FormatInt(cq.Message.Chat.ID, 10)) {
+		b.answer(ctx, cq, "⛔ This chat isn't allowed to control go-apts.")
+		return
+	}
+
+	parts := strings.Split(cq.Data, ":")
+	if len(parts) < 2 {
+		b.answer(ctx, cq, "Unknown button")
+		return
+	}
+	action, listing_id := parts[0], parts[1]
+
+	if action == notify.Callback_snooze {
+		if err := notify.Unit_states.Snooze(listing_id, snooze_for); err != nil {
+			log.Printf("bot: snoozing %s: %v\n", listing_id, err)
+			b.answer(ctx, cq, "⚠️ Couldn't snooze, try again")
+			return
+		}
+		b.answer(ctx, cq, "😴 No alerts for this building for 7 days")
+		return
+	}
+
+	known := action == notify.Callback_mute || action == notify.Callback_interested || action == notify.Callback_toured
+	if len(parts) != 3 || !known {
+		b.answer(ctx, cq, "Unknown button")
+		return
+	}
+	unit_id := parts[2]
+
+	var reply string
+	err := notify.Unit_states.Update_unit(listing_id, unit_id, func(u *unitstate.Unit_state) {
+		switch action {
+		case notify.Callback_mute:
+			u.Muted = true
+			reply = "🔇 Muted, this unit won't show up in alerts again"
+		case notify.Callback_interested:
+			u.Interested = !u.Interested
+			reply = "⭐ Marked interested, price changes will be highlighted"
+			if !u.Interested {
+				reply = "No longer marked interested"
+			}
+		case notify.Callback_toured:
+			u.Toured = !u.Toured
+			reply = "✅ Marked as toured"
+			if !u.Toured {
+				reply = "No longer marked toured"
+			}
+		}
+	})
+	if err != nil {
+		log.Printf("bot: updating unit %s/%s: %v\n", listing_id, unit_id, err)
+		reply = "⚠️ Couldn't save that, try again"
+	}
+
+	b.answer(ctx, cq, reply)
+}
+
+func (b *Bot) answer(ctx context.Context, cq *notify.Callback_query, text string) {
+	if err := b.Telegram.Answer_callback(ctx, cq.ID, text); err != nil {
+		log.Printf("bot: answering callback: %v\n", err)
+	}
+}
@@ -0,0 +1,116 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	notify "github.com/anthonybliss1/go-apts/internal/notify"
+	subscribers "github.com/anthonybliss1/go-apts/internal/subscribers"
+	watch "github.com/anthonybliss1/go-apts/internal/watch"
+)
+
+// watches a subscriber in chat_id follows that aren't already in mine
+func (b *Bot) subscribed_watches(chat_id string, mine []watch.Watch) ([]watch.Watch, error) {
+	if b.Telegram.Subscribers == nil {
+		return nil, nil
+	}
+
+	subs, err := b.Telegram.Subscribers.List()
+	if err != nil {
+		return nil, err
+	}
+	all, err := b.Watches.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var subscribed []watch.Watch
+	for _, wt := range all {
+		if slices.ContainsFunc(mine, func(m watch.Watch) bool { return m.ID == wt.ID }) {
+			continue
+		}
+		for _, sub := range subs {
+			if sub.ChatID == chat_id && sub.Follows(wt.ID) {
+				subscribed = append(subscribed, wt)
+				break
+			}
+		}
+	}
+	return subscribed, nil
+}
+
+// subscribe adds or removes watches for the chat (and topic) msg came from, registering it if it's new
+func (b *Bot) subscribe(msg *notify.Telegram_incoming, args []string, on bool) (string, error) {
+	if b.Telegram.Subscribers == nil {
+		return "", errors.New("subscriptions aren't available")
+	}
+	if len(args) == 0 {
+		return "", errors.New("usage: /subscribe <id|all> or /unsubscribe <id|all>")
+	}
+
+	id := strings.ToLower(args[0])
+	if id == "all" {
+		id = subscribers.All
+	} else if _, found, err := b.Watches.Get(id); err != nil {
+		return "", err
+	} else if !found {
+		return "", fmt.Errorf("no watch %q", id)
+	}
+
+	chat_id := strconv.FormatInt(msg.Chat.ID, 10)
+	key := subscribers.Target_key(chat_id, msg.MessageThreadID)
+
+	sub, found, err := b.Telegram.Subscribers.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		sub = subscribers.Subscriber{ChatID: chat_id, ThreadID: msg.MessageThreadID, Title: chat_title(msg.Chat), Type: msg.Chat.Type}
+	}
+
+	if on {
+		if !slices.Contains(sub.Watches, id) {
+			sub.Watches = append(sub.Watches, id)
+		}
+	} else {
+		if id != subscribers.All && slices.Contains(sub.Watches, subscribers.All) {
+			return "", errors.New("this chat is subscribed to every watch, /unsubscribe all first")
+		}
+		sub.Watches = slices.DeleteFunc(sub.Watches, func(w string) bool { return w == id || id == subscribers.All })
+	}
+
+	// nothing left to follow, drop the subscriber rather than keep an empty one around
+	if len(sub.Watches) == 0 {
+		if found {
+			if err := b.Telegram.Subscribers.Remove(key); err != nil {
+				return "", err
+			}
+		}
+		return "🔕 This chat won't get subscribed alerts any more", nil
+	}
+	if err := b.Telegram.Subscribers.Save(sub); err != nil {
+		return "", err
+	}
+
+	if !on {
+		return fmt.Sprintf("🔕 Unsubscribed from %s", args[0]), nil
+	}
+	if id == subscribers.All {
+		return "🔔 Subscribed to every watch", nil
+	}
+	return fmt.Sprintf("🔔 Subscribed to <code>%s</code>", id), nil
+}
+
+func chat_title(chat notify.Telegram_chat) string {
+	switch {
+	case chat.Title != "":
+		return chat.Title
+	case chat.Username != "":
+		return "@" + chat.Username
+	default:
+		return chat.FirstName
+	}
+}
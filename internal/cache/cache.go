@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Status says where a result came from, reported back to API callers in the X-Cache header
+type Status string
+
+const (
+	Hit       Status = "HIT"
+	Miss      Status = "MISS"
+	Coalesced Status = "COALESCED"
+)
+
+type entry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// how long a shared fetch gets once nobody's request is holding it up. covers a scrape
+// queueing on the rate limiter plus the scrape itself, same as the default write_timeout
+const fetch_timeout = 3 * time.Minute
+
+type call[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// Cache keeps fetched values for a TTL and collapses concurrent fetches of the same key into one
+type Cache[V any] struct {
+	ttl      time.Duration
+	mu       sync.Mutex
+	entries  map[string]entry[V]
+	inflight map[string]*call[V]
+}
+
+// a ttl of 0 turns off caching but concurrent fetches are still coalesced
+func New[V any](ttl time.Duration) *Cache[V] {
+	return &Cache[V]{
+		ttl:      ttl,
+		entries:  make(map[string]entry[V]),
+		inflight: make(map[string]*call[V]),
+	}
+}
+
+// Get_or_fetch returns the cached value for key if it's still fresh (unless force is set),
+// otherwise runs fetch once and shares the result with everyone asking for key at the same time.
+// errors are never cached. fetch gets its own ctx that keeps ctx's values but not its cancel, so the
+// first caller hanging up doesn't fail everyone coalesced onto it. ctx only decides how long this caller waits
+func (c *Cache[V]) Get_or_fetch(ctx context.Context, key string, force bool, fetch func(context.Context) (V, error)) (V, Status, error) {
+	c.mu.Lock()
+
+	if e, ok := c.entries[key]; ok && !force {
+		if time.Now().Before(e.expires) {
+			c.mu.Unlock()
+			return e.value, Hit, nil
+		}
+		delete(c.entries, key)
+	}
+
+	// someone is already fetching this key, wait for their answer instead of scraping again
+	if in, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		return c.wait(ctx, in, Coalesced)
+	}
+
+	in := &call[V]{done: make(chan struct{})}
+	c.inflight[key] = in
+	c.mu.Unlock()
+
+	fetch_ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), fetch_timeout)
+	go func() {
+		defer cancel()
+		value, err := fetch(fetch_ctx)
+		c.finish(key, in, value, err)
+	}()
+
+	return c.wait(ctx, in, Miss)
+}
+
+func (c *Cache[V]) wait(ctx context.Context, in *call[V], status Status) (V, Status, error) {
+	select {
+	case <-in.done:
+		return in.value, status, in.err
+	case <-ctx.Done():
+		var zero V
+		return zero, status, ctx.Err()
+	}
+}
+
+// finish stores a successful fetch and wakes everyone waiting on it
+func (c *Cache[V]) finish(key string, in *call[V], value V, err error) {
+	c.mu.Lock()
+	in.value, in.err = value, err
+	delete(c.inflight, key)
+	if err == nil && c.ttl > 0 {
+		now := time.Now()
+		// drop anything past its TTL so the map doesn't grow with one-off URLs
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.entries[key] = entry[V]{value: value, expires: now.Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	close(in.done)
+}
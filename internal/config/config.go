@@ -0,0 +1,433 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	digest "github.com/anthonybliss1/go-apts/internal/digest"
+	limiter "github.com/anthonybliss1/go-apts/internal/limiter"
+	rules "github.com/anthonybliss1/go-apts/internal/rules"
+	store "github.com/anthonybliss1/go-apts/internal/store"
+	watch "github.com/anthonybliss1/go-apts/internal/watch"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Env_config points at a config file when --config isn't given
+const Env_config = "GO_APTS_CONFIG"
+
+// Config is everything go-apts reads at startup. it's loaded from a YAML or TOML file (see
+// builds/config.example.yaml), then any env variable named in a field's env tag replaces that field,
+// so an existing .env keeps working on top of (or instead of) the file
+type Config struct {
+	Server    Server    `yaml:"server" toml:"server"`
+	Storage   Storage   `yaml:"storage" toml:"storage"`
+	Providers Providers `yaml:"providers" toml:"providers"`
+	Proxies   Proxies   `yaml:"proxies" toml:"proxies"`
+	Notifiers Notifiers `yaml:"notifiers" toml:"notifiers"`
+	Watches   []Watch   `yaml:"watches" toml:"watches"` // created (or updated) in the store at startup
+}
+
+// Server is the http.Server's address and limits. WriteTimeout has to cover a scrape waiting on the rate limiter
+type Server struct {
+	Listen            string   `yaml:"listen" toml:"listen" env:"LISTEN_ADDR"`
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout" toml:"read_header_timeout" env:"SERVER_READ_HEADER_TIMEOUT"`
+	ReadTimeout       Duration `yaml:"read_timeout" toml:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout      Duration `yaml:"write_timeout" toml:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout       Duration `yaml:"idle_timeout" toml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	MaxHeaderBytes    int      `yaml:"max_header_bytes" toml:"max_header_bytes" env:"SERVER_MAX_HEADER_BYTES"`
+	ShutdownTimeout   Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT"` // how long running work gets on SIGINT / SIGTERM
+}
+
+type Storage struct {
+	Store    string   `yaml:"store" toml:"store" env:"STORE_PATH"`
+	Sessions string   `yaml:"sessions" toml:"sessions" env:"SESSIONS_PATH"`
+	CacheTTL Duration `yaml:"cache_ttl" toml:"cache_ttl" env:"CACHE_TTL"` // 0 turns the scrape cache off
+}
+
+type Providers struct {
+	RateLimit Rate_limit `yaml:"rate_limit" toml:"rate_limit"`
+}
+
+// Rate_limit is limiter.Config, per provider host
+type Rate_limit struct {
+	RequestsPerMinute float64  `yaml:"requests_per_minute" toml:"requests_per_minute" env:"RATE_LIMIT_RPM"`
+	Burst             int      `yaml:"burst" toml:"burst" env:"RATE_LIMIT_BURST"`
+	MinSpacing        Duration `yaml:"min_spacing" toml:"min_spacing" env:"RATE_LIMIT_MIN_SPACING"`
+	Jitter            Duration `yaml:"jitter" toml:"jitter" env:"RATE_LIMIT_JITTER"`
+	MaxQueue          int      `yaml:"max_queue" toml:"max_queue" env:"RATE_LIMIT_MAX_QUEUE"`
+	MaxWait           Duration `yaml:"max_wait" toml:"max_wait" env:"RATE_LIMIT_MAX_WAIT"`
+}
+
+func (r Rate_limit) Limiter() limiter.Config {
+	return limiter.Config{
+		RequestsPerMinute: r.RequestsPerMinute,
+		Burst:             r.Burst,
+		MinSpacing:        r.MinSpacing.Std(),
+		Jitter:            r.Jitter.Std(),
+		MaxQueue:          r.MaxQueue,
+		MaxWait:           r.MaxWait.Std(),
+	}
+}
+
+// Proxies are OxyLabs residential proxies
+type Proxies struct {
+	Enabled  bool   `yaml:"enabled" toml:"enabled" env:"proxies_enabled"`
+	Username string `yaml:"username" toml:"username" env:"OXYLABS_USERNAME"`
+	Password string `yaml:"password" toml:"password" env:"OXYLABS_PASSWORD"`
+	Host     string `yaml:"host" toml:"host" env:"OXYLABS_PROXY_HOST"`
+	Port     string `yaml:"port" toml:"port" env:"OXYLABS_PROXY_PORT"`
+}
+
+type Notifiers struct {
+	DefaultChannels []string `yaml:"default_channels" toml:"default_channels" env:"NOTIFY_CHANNELS"` // for /chat calls that don't name any
+	TemplateDir     string   `yaml:"template_dir" toml:"template_dir" env:"NOTIFY_TEMPLATE_DIR"`
+	Delivery        Delivery `yaml:"delivery" toml:"delivery"`
+	Outbox          Outbox   `yaml:"outbox" toml:"outbox"`
+	Operator        Operator `yaml:"operator" toml:"operator"`
+
+	Telegram Telegram `yaml:"telegram" toml:"telegram"`
+	Slack    Slack    `yaml:"slack" toml:"slack"`
+	Discord  Discord  `yaml:"discord" toml:"discord"`
+	Email    Email    `yaml:"email" toml:"email"`
+	Ntfy     Ntfy     `yaml:"ntfy" toml:"ntfy"`
+	Gotify   Gotify   `yaml:"gotify" toml:"gotify"`
+	Matrix   Matrix   `yaml:"matrix" toml:"matrix"`
+	Sms      Sms      `yaml:"sms" toml:"sms"`
+	Mqtt     Mqtt     `yaml:"mqtt" toml:"mqtt"`
+	Webhook  Webhook  `yaml:"webhook" toml:"webhook"`
+}
+
+// Delivery is the policy for every channel, Channels overrides it field by field for one channel.
+// from the env those are <CHANNEL>_DELIVERY_MODE / _DELIVERY_AT / _QUIET_HOURS
+type Delivery struct {
+	Mode     string                   `yaml:"mode" toml:"mode" env:"DELIVERY_MODE"`
+	At       string                   `yaml:"at" toml:"at" env:"DELIVERY_AT"`
+	Quiet    string                   `yaml:"quiet" toml:"quiet" env:"QUIET_HOURS"`
+	Timezone string                   `yaml:"timezone" toml:"timezone" env:"DELIVERY_TZ"`
+	Channels map[string]digest.Policy `yaml:"channels" toml:"channels"`
+}
+
+// For is the policy channel uses when a watch doesn't set one
+func (d Delivery) For(channel string) digest.Policy {
+	p := digest.Policy{Mode: d.Mode, At: d.At, Quiet: d.Quiet, Timezone: d.Timezone}
+
+	override := d.Channels[channel]
+	if override.Mode != "" {
+		p.Mode = override.Mode
+	}
+	if override.At != "" {
+		p.At = override.At
+	}
+	if override.Quiet != "" {
+		p.Quiet = override.Quiet
+	}
+	if override.Timezone != "" {
+		p.Timezone = override.Timezone
+	}
+	return p
+}
+
+type Outbox struct {
+	MaxAttempts  int      `yaml:"max_attempts" toml:"max_attempts" env:"OUTBOX_MAX_ATTEMPTS"`
+	DedupeWindow Duration `yaml:"dedupe_window" toml:"dedupe_window" env:"OUTBOX_DEDUPE_WINDOW"`
+}
+
+// Operator gets parser health alerts through the telegram bot
+type Operator struct {
+	TelegramChatID string `yaml:"telegram_chat_id" toml:"telegram_chat_id" env:"OPERATOR_TELEGRAM_CHAT_ID"`
+}
+
+type Telegram struct {
+	Enabled        bool     `yaml:"enabled" toml:"enabled" env:"telegram_enabled"`
+	BotToken       string   `yaml:"bot_token" toml:"bot_token" env:"TELEGRAM_BOT_TOKEN"`
+	ChatID         string   `yaml:"chat_id" toml:"chat_id" env:"TELEGRAM_CHAT_ID"`
+	APIBase        string   `yaml:"api_base" toml:"api_base" env:"TELEGRAM_API_BASE"`
+	Albums         bool     `yaml:"albums" toml:"albums" env:"TELEGRAM_ALBUMS"`
+	AlbumPhotos    int      `yaml:"album_photos" toml:"album_photos" env:"TELEGRAM_ALBUM_PHOTOS"`
+	Commands       string   `yaml:"commands" toml:"commands" env:"TELEGRAM_COMMANDS"` // poll, webhook or off
+	AllowedChatIDs []string `yaml:"allowed_chat_ids" toml:"allowed_chat_ids" env:"TELEGRAM_ALLOWED_CHAT_IDS"`
+	WebhookURL     string   `yaml:"webhook_url" toml:"webhook_url" env:"TELEGRAM_WEBHOOK_URL"`
+	WebhookSecret  string   `yaml:"webhook_secret" toml:"webhook_secret" env:"TELEGRAM_WEBHOOK_SECRET"`
+}
+
+// Slack and Discord are on when they have a webhook url, or when enabled for watches that bring their own
+type Slack struct {
+	Enabled    bool   `yaml:"enabled" toml:"enabled" env:"slack_enabled"`
+	WebhookURL string `yaml:"webhook_url" toml:"webhook_url" env:"SLACK_WEBHOOK_URL"`
+}
+
+type Discord struct {
+	Enabled    bool   `yaml:"enabled" toml:"enabled" env:"discord_enabled"`
+	WebhookURL string `yaml:"webhook_url" toml:"webhook_url" env:"DISCORD_WEBHOOK_URL"`
+}
+
+type Email struct {
+	Host     string   `yaml:"host" toml:"host" env:"SMTP_HOST"`
+	Port     string   `yaml:"port" toml:"port" env:"SMTP_PORT"`
+	TLS      string   `yaml:"tls" toml:"tls" env:"SMTP_TLS"` // starttls, implicit or none, picked from the port when empty
+	Username string   `yaml:"username" toml:"username" env:"SMTP_USERNAME"`
+	Password string   `yaml:"password" toml:"password" env:"SMTP_PASSWORD"`
+	From     string   `yaml:"from" toml:"from" env:"SMTP_FROM"`
+	To       []string `yaml:"to" toml:"to" env:"SMTP_TO"`
+}
+
+type Ntfy struct {
+	Enabled bool   `yaml:"enabled" toml:"enabled" env:"ntfy_enabled"`
+	Server  string `yaml:"server" toml:"server" env:"NTFY_SERVER"`
+	Topic   string `yaml:"topic" toml:"topic" env:"NTFY_TOPIC"`
+	Token   string `yaml:"token" toml:"token" env:"NTFY_TOKEN"`
+}
+
+type Gotify struct {
+	URL   string `yaml:"url" toml:"url" env:"GOTIFY_URL"`
+	Token string `yaml:"token" toml:"token" env:"GOTIFY_TOKEN"`
+}
+
+type Matrix struct {
+	Homeserver  string   `yaml:"homeserver" toml:"homeserver" env:"MATRIX_HOMESERVER"`
+	AccessToken string   `yaml:"access_token" toml:"access_token" env:"MATRIX_ACCESS_TOKEN"`
+	Rooms       []string `yaml:"rooms" toml:"rooms" env:"MATRIX_ROOMS"`
+}
+
+type Sms struct {
+	AccountSID string   `yaml:"account_sid" toml:"account_sid" env:"TWILIO_ACCOUNT_SID"`
+	AuthToken  string   `yaml:"auth_token" toml:"auth_token" env:"TWILIO_AUTH_TOKEN"`
+	From       string   `yaml:"from" toml:"from" env:"TWILIO_FROM"`
+	APIBase    string   `yaml:"api_base" toml:"api_base" env:"TWILIO_API_BASE"`
+	To         []string `yaml:"to" toml:"to" env:"SMS_TO"`
+	DailyLimit int      `yaml:"daily_limit" toml:"daily_limit" env:"SMS_DAILY_LIMIT"` // 0 for no limit
+}
+
+type Mqtt struct {
+	Broker          string `yaml:"broker" toml:"broker" env:"MQTT_BROKER"`
+	Username        string `yaml:"username" toml:"username" env:"MQTT_USERNAME"`
+	Password        string `yaml:"password" toml:"password" env:"MQTT_PASSWORD"`
+	ClientID        string `yaml:"client_id" toml:"client_id" env:"MQTT_CLIENT_ID"`
+	TopicPrefix     string `yaml:"topic_prefix" toml:"topic_prefix" env:"MQTT_TOPIC_PREFIX"`
+	Discovery       bool   `yaml:"discovery" toml:"discovery" env:"MQTT_DISCOVERY"`
+	DiscoveryPrefix string `yaml:"discovery_prefix" toml:"discovery_prefix" env:"MQTT_DISCOVERY_PREFIX"`
+}
+
+type Webhook struct {
+	Enabled bool     `yaml:"enabled" toml:"enabled" env:"webhook_enabled"`
+	URLs    []string `yaml:"urls" toml:"urls" env:"WEBHOOK_URLS"`
+	Secret  string   `yaml:"secret" toml:"secret" env:"WEBHOOK_SECRET"`
+}
+
+// Watch is a watch kept in the config file, the same fields as POST /watches plus a fixed id
+type Watch struct {
+	ID         string                   `yaml:"id" toml:"id"`
+	URL        string                   `yaml:"url" toml:"url"`
+	Channels   []string                 `yaml:"channels" toml:"channels"`
+	Targets    map[string]string        `yaml:"targets" toml:"targets"`
+	TargetRent float64                  `yaml:"target_rent" toml:"target_rent"`
+	Interval   string                   `yaml:"interval" toml:"interval"`
+	Templates  map[string]string        `yaml:"templates" toml:"templates"`
+	Delivery   map[string]digest.Policy `yaml:"delivery" toml:"delivery"`
+	Rules      []Rule                   `yaml:"rules" toml:"rules"`
+}
+
+type Rule struct {
+	Type        string   `yaml:"type" toml:"type"`
+	DropAmount  float64  `yaml:"drop_amount" toml:"drop_amount"`
+	DropPercent float64  `yaml:"drop_percent" toml:"drop_percent"`
+	TargetRent  float64  `yaml:"target_rent" toml:"target_rent"`
+	Beds        int      `yaml:"beds" toml:"beds"`
+	Priority    string   `yaml:"priority" toml:"priority"`
+	Channels    []string `yaml:"channels" toml:"channels"`
+}
+
+func (r Rule) Rule() rules.Rule {
+	return rules.Rule{
+		Type:        r.Type,
+		DropAmount:  r.DropAmount,
+		DropPercent: r.DropPercent,
+		TargetRent:  r.TargetRent,
+		Beds:        r.Beds,
+		Priority:    r.Priority,
+		Channels:    r.Channels,
+	}
+}
+
+func (w Watch) Watch() watch.Watch {
+	var watch_rules []rules.Rule
+	for _, r := range w.Rules {
+		watch_rules = append(watch_rules, r.Rule())
+	}
+
+	return watch.Watch{
+		ID:         w.ID,
+		URL:        w.URL,
+		Channels:   w.Channels,
+		Targets:    w.Targets,
+		TargetRent: w.TargetRent,
+		Interval:   w.Interval,
+		Templates:  w.Templates,
+		Delivery:   w.Delivery,
+		Rules:      watch_rules,
+	}
+}
+
+// Duration reads "90s" / "5m" from a file or the env
+type Duration time.Duration
+
+func (d Duration) Std() time.Duration { return time.Duration(d) }
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	parsed, err := time.ParseDuration(strings.TrimSpace(string(b)))
+	if err != nil {
+		return fmt.Errorf("%q isn't a duration like 90s or 5m", string(b))
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// yaml hands back UnmarshalText errors without saying where, this adds the line
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	if err := d.UnmarshalText([]byte(node.Value)); err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	return nil
+}
+
+// Default is the config with nothing set, what go-apts used before there was a config file
+func Default() Config {
+	rate := limiter.Default_config()
+
+	return Config{
+		Server: Server{
+			Listen:            "0.0.0.0:8000",
+			ReadHeaderTimeout: Duration(10 * time.Second),
+			ReadTimeout:       Duration(30 * time.Second),
+			WriteTimeout:      Duration(3 * time.Minute),
+			IdleTimeout:       Duration(2 * time.Minute),
+			MaxHeaderBytes:    64 << 10,
+			ShutdownTimeout:   Duration(60 * time.Second),
+		},
+		Storage: Storage{
+			Store:    store.Default_path,
+			Sessions: "sessions.json",
+			CacheTTL: Duration(5 * time.Minute),
+		},
+		Providers: Providers{RateLimit: Rate_limit{
+			RequestsPerMinute: rate.RequestsPerMinute,
+			Burst:             rate.Burst,
+			MinSpacing:        Duration(rate.MinSpacing),
+			Jitter:            Duration(rate.Jitter),
+			MaxQueue:          rate.MaxQueue,
+			MaxWait:           Duration(rate.MaxWait),
+		}},
+		Notifiers: Notifiers{
+			DefaultChannels: []string{"telegram"},
+			Outbox:          Outbox{MaxAttempts: 8, DedupeWindow: Duration(10 * time.Minute)},
+			Telegram: Telegram{
+				APIBase:     "https://api.telegram.org",
+				Albums:      true,
+				AlbumPhotos: 3,
+				Commands:    "poll",
+			},
+			Email: Email{Port: "587"},
+			Ntfy:  Ntfy{Server: "https://ntfy.sh"},
+			Sms:   Sms{APIBase: "https://api.twilio.com", DailyLimit: 10},
+			Mqtt: Mqtt{
+				ClientID:        "go-apts",
+				TopicPrefix:     "go-apts",
+				Discovery:       true,
+				DiscoveryPrefix: "homeassistant",
+			},
+		},
+	}
+}
+
+// Dir is $XDG_CONFIG_HOME/go-apts (~/.config/go-apts on linux, ~/Library/Application Support/go-apts on macOS)
+func Dir() (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "go-apts"), nil
+}
+
+// Default_path is the config file in Dir, config.yaml unless there's a .yml or .toml one instead
+func Default_path() string {
+	dir, err := Dir()
+	if err != nil {
+		return ""
+	}
+
+	for _, name := range []string{"config.yaml", "config.yml", "config.toml"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return filepath.Join(dir, "config.yaml")
+}
+
+// Env_path is the .env --setup writes to, next to the config file rather than the binary
+func Env_path(config_path string) string {
+	if config_path == "" {
+		return ".env"
+	}
+	return filepath.Join(filepath.Dir(config_path), ".env")
+}
+
+// Load reads the config at path (a missing file is fine, it's all defaults then), applies the env on top
+// and validates the result. errors name the field, e.g. "notifiers.email.from: required when host is set"
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return cfg, fmt.Errorf("reading config: %w", err)
+		default:
+			if err := decode(path, b, &cfg); err != nil {
+				return cfg, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+
+	if err := apply_env(&cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func decode(path string, b []byte, cfg *Config) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return nil
+
+	case ".toml":
+		md, err := toml.Decode(string(b), cfg)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown field", undecoded[0])
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("config must be .yaml, .yml or .toml")
+	}
+}
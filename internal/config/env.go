@@ -0,0 +1,149 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	digest "github.com/anthonybliss1/go-apts/internal/digest"
+)
+
+// channels that can have their own <CHANNEL>_DELIVERY_MODE / _DELIVERY_AT / _QUIET_HOURS
+var channel_names = []string{"telegram", "slack", "discord", "email", "ntfy", "gotify", "matrix", "sms", "mqtt", "webhook"}
+
+var duration_type = reflect.TypeOf(Duration(0))
+
+// apply_env replaces every field with an env tag whose variable is set (and not empty, so the blank
+// lines in .env.template don't wipe out the file)
+func apply_env(cfg *Config) error {
+	if err := env_struct(reflect.ValueOf(cfg).Elem(), ""); err != nil {
+		return err
+	}
+
+	for _, channel := range channel_names {
+		prefix := strings.ToUpper(channel) + "_"
+		policy := cfg.Notifiers.Delivery.Channels[channel]
+		set := false
+		for key, dst := range map[string]*string{"DELIVERY_MODE": &policy.Mode, "DELIVERY_AT": &policy.At, "QUIET_HOURS": &policy.Quiet} {
+			if v := os.Getenv(prefix + key); v != "" {
+				*dst = v
+				set = true
+			}
+		}
+		if set {
+			if cfg.Notifiers.Delivery.Channels == nil {
+				cfg.Notifiers.Delivery.Channels = make(map[string]digest.Policy)
+			}
+			cfg.Notifiers.Delivery.Channels[channel] = policy
+		}
+	}
+	return nil
+}
+
+func env_struct(v reflect.Value, path string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		field_path := join_path(path, field_name(field))
+
+		if field.Type.Kind() == reflect.Struct && field.Type != duration_type {
+			if err := env_struct(v.Field(i), field_path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		key := field.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+		raw := os.Getenv(key)
+		if raw == "" {
+			continue
+		}
+		if err := set_field(v.Field(i), raw); err != nil {
+			return fmt.Errorf("%s (from %s): %v", field_path, key, err)
+		}
+	}
+	return nil
+}
+
+func set_field(v reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	switch {
+	case v.Type() == duration_type:
+		var d Duration
+		if err := d.UnmarshalText([]byte(raw)); err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(d))
+
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+
+	case v.Kind() == reflect.Bool:
+		b, err := parse_bool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q isn't a whole number", raw)
+		}
+		v.SetInt(int64(n))
+
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%q isn't a number", raw)
+		}
+		v.SetFloat(f)
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		// comma separated, like the old env variables
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+
+	default:
+		return fmt.Errorf("can't be set from the env")
+	}
+	return nil
+}
+
+// the .env flags were always "y" / "n"
+func parse_bool(raw string) (bool, error) {
+	switch strings.ToLower(raw) {
+	case "y", "yes", "true", "1", "on":
+		return true, nil
+	case "n", "no", "false", "0", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q isn't y or n", raw)
+}
+
+// a field's name in the file, which is also how errors refer to it
+func field_name(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+func join_path(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,250 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	rules "github.com/anthonybliss1/go-apts/internal/rules"
+	watch "github.com/anthonybliss1/go-apts/internal/watch"
+)
+
+// problems collects every bad field, so one run of go-apts shows all of them instead of one per restart
+type problems []error
+
+func (p *problems) add(field string, format string, args ...any) {
+	*p = append(*p, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+// Validate names every field that's wrong, by its path in the file ("providers.rate_limit.burst")
+func (c Config) Validate() error {
+	var p problems
+
+	if _, port, err := net.SplitHostPort(c.Server.Listen); err != nil || port == "" {
+		p.add("server.listen", "must be host:port like 0.0.0.0:8000, got %q", c.Server.Listen)
+	}
+	timeouts := []struct {
+		field string
+		value Duration
+	}{
+		{"read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"read_timeout", c.Server.ReadTimeout},
+		{"write_timeout", c.Server.WriteTimeout},
+		{"idle_timeout", c.Server.IdleTimeout},
+		{"shutdown_timeout", c.Server.ShutdownTimeout},
+	}
+	for _, t := range timeouts {
+		// 0 would mean no timeout at all, which is what the server is hardened against
+		if t.value <= 0 {
+			p.add("server."+t.field, "must be more than 0")
+		}
+	}
+	if c.Server.MaxHeaderBytes < 4<<10 {
+		p.add("server.max_header_bytes", "must be at least 4096, got %d", c.Server.MaxHeaderBytes)
+	}
+
+	if c.Storage.Store == "" {
+		p.add("storage.store", "required")
+	}
+	if c.Storage.CacheTTL < 0 {
+		p.add("storage.cache_ttl", "can't be negative")
+	}
+
+	rate := c.Providers.RateLimit
+	if rate.RequestsPerMinute <= 0 {
+		p.add("providers.rate_limit.requests_per_minute", "must be more than 0, got %v", rate.RequestsPerMinute)
+	}
+	if rate.Burst < 1 {
+		p.add("providers.rate_limit.burst", "must be at least 1, got %d", rate.Burst)
+	}
+	if rate.MaxQueue < 1 {
+		p.add("providers.rate_limit.max_queue", "must be at least 1, got %d", rate.MaxQueue)
+	}
+	if rate.MinSpacing < 0 {
+		p.add("providers.rate_limit.min_spacing", "can't be negative")
+	}
+	if rate.Jitter < 0 {
+		p.add("providers.rate_limit.jitter", "can't be negative")
+	}
+	// 0 would turn away every request that has to queue with a 429
+	if rate.MaxWait <= 0 {
+		p.add("providers.rate_limit.max_wait", "must be more than 0")
+	}
+
+	if c.Proxies.Enabled {
+		required := []struct{ field, value string }{
+			{"username", c.Proxies.Username},
+			{"password", c.Proxies.Password},
+			{"host", c.Proxies.Host},
+			{"port", c.Proxies.Port},
+		}
+		for _, r := range required {
+			if r.value == "" {
+				p.add("proxies."+r.field, "required when proxies are enabled")
+			}
+		}
+	}
+
+	c.Notifiers.validate(&p)
+
+	ids := make(map[string]int)
+	for i, w := range c.Watches {
+		field := fmt.Sprintf("watches[%d]", i)
+		if prev, ok := ids[w.ID]; ok && w.ID != "" {
+			p.add(field+".id", "%q is already used by watches[%d]", w.ID, prev)
+		}
+		ids[w.ID] = i
+		w.validate(field, &p)
+	}
+
+	// errors.Join puts each one on its own line
+	return errors.Join(p...)
+}
+
+func (n Notifiers) validate(p *problems) {
+	for i, name := range n.DefaultChannels {
+		if strings.TrimSpace(name) == "" {
+			p.add(fmt.Sprintf("notifiers.default_channels[%d]", i), "empty channel name")
+		}
+	}
+
+	if err := n.Delivery.For("").Validate(); err != nil {
+		p.add("notifiers.delivery", "%v", err)
+	}
+	for _, channel := range sorted_keys(n.Delivery.Channels) {
+		if err := n.Delivery.For(channel).Validate(); err != nil {
+			p.add("notifiers.delivery.channels."+channel, "%v", err)
+		}
+	}
+
+	if n.Outbox.MaxAttempts < 1 {
+		p.add("notifiers.outbox.max_attempts", "must be at least 1, got %d", n.Outbox.MaxAttempts)
+	}
+	if n.Outbox.DedupeWindow < 0 {
+		p.add("notifiers.outbox.dedupe_window", "can't be negative")
+	}
+
+	t := n.Telegram
+	if t.Enabled {
+		if t.BotToken == "" {
+			p.add("notifiers.telegram.bot_token", "required when telegram is enabled")
+		}
+		if t.ChatID == "" {
+			p.add("notifiers.telegram.chat_id", "required when telegram is enabled")
+		}
+	}
+	if t.AlbumPhotos < 0 {
+		p.add("notifiers.telegram.album_photos", "must be 0 or more, got %d", t.AlbumPhotos)
+	}
+	switch t.Commands {
+	case "poll", "webhook", "off":
+	default:
+		p.add("notifiers.telegram.commands", "must be poll, webhook or off, got %q", t.Commands)
+	}
+	// the chat id in an update is all that's checked otherwise, and anyone who finds the URL can forge that
+	if t.Enabled && t.Commands == "webhook" && t.WebhookSecret == "" {
+		p.add("notifiers.telegram.webhook_secret", "required when commands is webhook")
+	}
+	// what telegram accepts as a secret_token
+	if strings.Trim(t.WebhookSecret, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_-") != "" || len(t.WebhookSecret) > 256 {
+		p.add("notifiers.telegram.webhook_secret", "can only be up to 256 letters, digits, _ and -")
+	}
+	check_url(p, "notifiers.telegram.api_base", t.APIBase)
+	check_url(p, "notifiers.telegram.webhook_url", t.WebhookURL)
+
+	check_url(p, "notifiers.slack.webhook_url", n.Slack.WebhookURL)
+	check_url(p, "notifiers.discord.webhook_url", n.Discord.WebhookURL)
+
+	e := n.Email
+	if e.Host != "" && e.From == "" {
+		p.add("notifiers.email.from", "required when host is set")
+	}
+	if _, err := strconv.Atoi(e.Port); e.Port != "" && err != nil {
+		p.add("notifiers.email.port", "%q isn't a port number", e.Port)
+	}
+	switch strings.ToLower(e.TLS) {
+	case "", "starttls", "implicit", "none":
+	default:
+		p.add("notifiers.email.tls", "must be starttls, implicit or none, got %q", e.TLS)
+	}
+
+	check_url(p, "notifiers.ntfy.server", n.Ntfy.Server)
+	check_url(p, "notifiers.gotify.url", n.Gotify.URL)
+
+	if n.Matrix.Homeserver != "" && n.Matrix.AccessToken == "" {
+		p.add("notifiers.matrix.access_token", "required when homeserver is set")
+	}
+	check_url(p, "notifiers.matrix.homeserver", n.Matrix.Homeserver)
+
+	s := n.Sms
+	if s.AccountSID != "" {
+		if s.AuthToken == "" {
+			p.add("notifiers.sms.auth_token", "required when account_sid is set")
+		}
+		if s.From == "" {
+			p.add("notifiers.sms.from", "required when account_sid is set")
+		}
+	}
+	if s.DailyLimit < 0 {
+		p.add("notifiers.sms.daily_limit", "must be 0 or more, got %d", s.DailyLimit)
+	}
+	check_url(p, "notifiers.sms.api_base", s.APIBase)
+
+	for i, u := range n.Webhook.URLs {
+		check_url(p, fmt.Sprintf("notifiers.webhook.urls[%d]", i), u)
+	}
+}
+
+// only the things that don't need the channel registry, main checks channels and templates once it's built
+func (w Watch) validate(field string, p *problems) {
+	if w.ID == "" {
+		p.add(field+".id", "required, it's how the watch is found again on the next start")
+	}
+	if parsed, err := url.Parse(w.URL); err != nil || parsed.Host == "" {
+		p.add(field+".url", "%q is not a listing URL", w.URL)
+	}
+	if !watch.Valid_interval(w.Interval) {
+		p.add(field+".interval", "must be hourly, daily or weekly, got %q", w.Interval)
+	}
+	if w.TargetRent < 0 {
+		p.add(field+".target_rent", "can't be negative")
+	}
+
+	for _, channel := range sorted_keys(w.Delivery) {
+		if err := w.Delivery[channel].Validate(); err != nil {
+			p.add(field+".delivery."+channel, "%v", err)
+		}
+	}
+
+	for i, r := range w.Rules {
+		rule_field := fmt.Sprintf("%s.rules[%d]", field, i)
+		if err := r.Rule().Validate(); err != nil {
+			p.add(rule_field, "%v", err)
+		}
+		if r.Type == rules.Under_target && r.TargetRent == 0 && w.TargetRent == 0 {
+			p.add(rule_field+".target_rent", "required when the watch has no target_rent")
+		}
+	}
+}
+
+func check_url(p *problems, field string, raw string) {
+	if raw == "" {
+		return
+	}
+	if parsed, err := url.Parse(raw); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		p.add(field, "%q isn't a URL", raw)
+	}
+}
+
+func sorted_keys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
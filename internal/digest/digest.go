@@ -0,0 +1,150 @@
+package digest
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// delivery modes
+const (
+	Realtime = "realtime"
+	Hourly   = "hourly"
+	Daily    = "daily"
+)
+
+// the daily digest goes out at 08:00 unless At says otherwise
+const default_at = "08:00"
+
+// Policy is when a channel's alerts go out. anything not sent straight away is queued and merged into one digest
+type Policy struct {
+	Mode     string // realtime (default), hourly or daily
+	At       string // time of the daily digest, 15:04 in Timezone
+	Quiet    string // quiet hours like 22:00-07:00, alerts in them wait until they're over
+	Timezone string // IANA name (America/New_York), the server's own when empty
+}
+
+// Validate names the first field that's wrong
+func (p Policy) Validate() error {
+	switch p.Mode {
+	case "", Realtime, Hourly, Daily:
+	default:
+		return fmt.Errorf("mode must be realtime, hourly or daily, got %q", p.Mode)
+	}
+
+	if p.At != "" {
+		if _, err := clock(p.At); err != nil {
+			return fmt.Errorf("at: %w", err)
+		}
+	}
+	if p.Quiet != "" {
+		if _, _, err := quiet_range(p.Quiet); err != nil {
+			return fmt.Errorf("quiet: %w", err)
+		}
+	}
+	if _, err := time.LoadLocation(p.Timezone); err != nil {
+		return fmt.Errorf("timezone: %w", err)
+	}
+	return nil
+}
+
+func (p Policy) mode() string {
+	if p.Mode == "" {
+		return Realtime
+	}
+	return p.Mode
+}
+
+func (p Policy) location() *time.Location {
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// minutes after midnight for "15:04"
+func clock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q isn't a HH:MM time", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func quiet_range(s string) (int, int, error) {
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("%q isn't a HH:MM-HH:MM range", s)
+	}
+
+	start, err := clock(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := clock(to)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// Is_quiet is true when now falls in the quiet hours (which can run past midnight)
+func (p Policy) Is_quiet(now time.Time) bool {
+	if p.Quiet == "" {
+		return false
+	}
+	start, end, err := quiet_range(p.Quiet)
+	if err != nil || start == end {
+		return false
+	}
+
+	local := now.In(p.location())
+	minute := local.Hour()*60 + local.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// Hold is true when an alert shouldn't go out right now and belongs in the queue
+func (p Policy) Hold(now time.Time) bool {
+	return p.mode() != Realtime || p.Is_quiet(now)
+}
+
+// Due is true when alerts queued since since should be sent as a digest
+func (p Policy) Due(since time.Time, now time.Time) bool {
+	if p.Is_quiet(now) {
+		return false
+	}
+
+	switch p.mode() {
+	case Hourly:
+		// on the hour, for whatever came in during the last one
+		return now.Truncate(time.Hour).After(since)
+	case Daily:
+		return !now.Before(p.next_daily(since))
+	default:
+		// realtime alerts were only held for quiet hours
+		return true
+	}
+}
+
+// the first daily digest time after t
+func (p Policy) next_daily(t time.Time) time.Time {
+	at := p.At
+	if at == "" {
+		at = default_at
+	}
+	minutes, err := clock(at)
+	if err != nil {
+		minutes, _ = clock(default_at)
+	}
+
+	local := t.In(p.location())
+	next := time.Date(local.Year(), local.Month(), local.Day(), minutes/60, minutes%60, 0, 0, local.Location())
+	if !next.After(local) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
@@ -0,0 +1,174 @@
+package health
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	store "github.com/anthonybliss1/go-apts/internal/store"
+)
+
+// kinds of structural failure, each one usually means the provider changed their markup
+type Failure string
+
+const (
+	MissingBlob  Failure = "missing_blob"  // page fetched fine but the rentals blob wasn't there
+	SchemaChange Failure = "schema_change" // rentals blob parsed but expected fields are gone
+	BadJSON      Failure = "bad_json"      // rentals blob found but isn't valid JSON anymore
+	ZeroDrop     Failure = "zero_drop"     // a listing that always had units suddenly has none
+)
+
+const (
+	stats_bucket   = "parse_health"
+	counts_bucket  = "listing_unit_counts"
+	counts_kept    = 10
+	zero_drop_runs = 3 // how many non-empty scrapes in a row make a listing one that "always has units"
+
+	// same failure on the same provider won't page the operator more than once in this window
+	alert_cooldown = 6 * time.Hour
+)
+
+type Provider_stats struct {
+	Provider          string
+	Fetches           int
+	Parsed            int
+	Failures          map[Failure]int
+	ConsecutiveFails  int
+	LastSuccess       time.Time
+	LastFailure       time.Time
+	LastFailureKind   Failure
+	LastFailureDetail string
+}
+
+// operator alerts go somewhere other than tenant notifications (see notify.Operator_alert)
+type Alert_func func(subject string, body string) error
+
+type Monitor struct {
+	mu         sync.Mutex
+	store      *store.Store
+	alert      Alert_func
+	last_alert map[string]time.Time
+}
+
+func New_monitor(s *store.Store, alert Alert_func) *Monitor {
+	return &Monitor{store: s, alert: alert, last_alert: make(map[string]time.Time)}
+}
+
+func (m *Monitor) stats(provider string) Provider_stats {
+	var st Provider_stats
+	if _, err := m.store.Get(stats_bucket, provider, &st); err != nil {
+		log.Printf("reading parse health for %s: %v\n", provider, err)
+	}
+	st.Provider = provider
+	if st.Failures == nil {
+		st.Failures = make(map[Failure]int)
+	}
+	return st
+}
+
+func (m *Monitor) save(st Provider_stats) {
+	if err := m.store.Put(stats_bucket, st.Provider, st); err != nil {
+		log.Printf("saving parse health for %s: %v\n", st.Provider, err)
+	}
+}
+
+// Record_success is called after a page parsed cleanly. unit_count is every unit in the rentals blob
+// (before filtering by availability) so a building going quiet isn't mistaken for drift
+func (m *Monitor) Record_success(provider string, listing_url string, unit_count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := m.stats(provider)
+	st.Fetches++
+	st.Parsed++
+	st.ConsecutiveFails = 0
+	st.LastSuccess = time.Now()
+
+	var counts []int
+	if _, err := m.store.Get(counts_bucket, listing_url, &counts); err != nil {
+		log.Printf("reading unit counts for %s: %v\n", listing_url, err)
+	}
+
+	if unit_count == 0 && len(counts) >= zero_drop_runs && all_non_zero(counts[len(counts)-zero_drop_runs:]) {
+		detail := fmt.Sprintf("%s returned 0 units after %d scrapes in a row with units (last: %d)", listing_url, zero_drop_runs, counts[len(counts)-1])
+		m.fail(&st, ZeroDrop, detail)
+	}
+
+	counts = append(counts, unit_count)
+	if len(counts) > counts_kept {
+		counts = counts[len(counts)-counts_kept:]
+	}
+	if err := m.store.Put(counts_bucket, listing_url, counts); err != nil {
+		log.Printf("saving unit counts for %s: %v\n", listing_url, err)
+	}
+
+	m.save(st)
+}
+
+// Record_failure is called when a fetched page couldn't be parsed the way we expect
+func (m *Monitor) Record_failure(provider string, listing_url string, kind Failure, detail string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := m.stats(provider)
+	st.Fetches++
+	st.ConsecutiveFails++
+	m.fail(&st, kind, fmt.Sprintf("%s: %s", listing_url, detail))
+	m.save(st)
+}
+
+// a schema change can come with a page that still parsed, so it's counted without touching Parsed/Fetches
+func (m *Monitor) Record_warning(provider string, listing_url string, kind Failure, detail string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := m.stats(provider)
+	m.fail(&st, kind, fmt.Sprintf("%s: %s", listing_url, detail))
+	m.save(st)
+}
+
+func (m *Monitor) fail(st *Provider_stats, kind Failure, detail string) {
+	st.Failures[kind]++
+	st.LastFailure = time.Now()
+	st.LastFailureKind = kind
+	st.LastFailureDetail = detail
+
+	log.Printf("parser health: %s %s: %s\n", st.Provider, kind, detail)
+
+	key := st.Provider + "/" + string(kind)
+	if time.Since(m.last_alert[key]) < alert_cooldown || m.alert == nil {
+		return
+	}
+	m.last_alert[key] = time.Now()
+
+	subject := fmt.Sprintf("go-apts parser health: %s on %s", kind, st.Provider)
+	body := fmt.Sprintf("%s\n\nparsed %d of %d fetches, %d failures in a row. The provider may have changed its markup.", detail, st.Parsed, st.Fetches, st.ConsecutiveFails)
+
+	// don't hold up the scrape on the alert
+	go func() {
+		if err := m.alert(subject, body); err != nil {
+			log.Printf("sending operator alert: %v\n", err)
+		}
+	}()
+}
+
+func (m *Monitor) Stats() []Provider_stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var all []Provider_stats
+	for _, provider := range m.store.Keys(stats_bucket) {
+		all = append(all, m.stats(provider))
+	}
+	return all
+}
+
+func all_non_zero(counts []int) bool {
+	for _, c := range counts {
+		if c == 0 {
+			return false
+		}
+	}
+	return true
+}
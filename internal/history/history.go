@@ -0,0 +1,228 @@
+package history
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	store "github.com/anthonybliss1/go-apts/internal/store"
+)
+
+const bucket = "listing_history"
+
+type Kind string
+
+const (
+	Added     Kind = "added"
+	PriceDrop Kind = "price_drop"
+	PriceUp   Kind = "price_up"
+	Unchanged Kind = "unchanged"
+	Removed   Kind = "removed"
+)
+
+// Change is what happened to one unit since the last time the listing was scraped
+type Change struct {
+	Kind    Kind
+	Unit    utils.Apartments
+	OldRent float64 // rent on the previous scrape, 0 for new units. a relisted unit (Added again) has the rent it went at
+	Peak    float64 // highest rent the unit was listed at before this scrape, 0 for units never seen before
+}
+
+type Diff struct {
+	First   bool              // nothing was stored for this listing yet, so every unit counts as added
+	Changes map[string]Change // keyed by Unit_key, one per unit in the current scrape
+	Removed []Change          // units from the last scrape that are gone now
+}
+
+// what changed for apt, Unchanged if the diff doesn't know about it
+func (d Diff) Change_for(apt utils.Apartments) Change {
+	if c, ok := d.Changes[Unit_key(apt)]; ok {
+		return c
+	}
+	return Change{Kind: Unchanged, Unit: apt}
+}
+
+// how many rent changes are kept per unit
+const rents_kept = 50
+
+// how long a unit that came off the listing keeps its rents, so one that's relisted still has its peak
+const gone_kept = 30 * 24 * time.Hour
+
+// Rent_point is the rent a unit was listed at from At on
+type Rent_point struct {
+	Rent float64
+	At   time.Time
+}
+
+type unit_state struct {
+	Unit      utils.Apartments
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Rents     []Rent_point // every change of rent, oldest first
+}
+
+// rents of a stored unit, snapshots from before rents were kept only have the last one
+func (u unit_state) rents() []Rent_point {
+	if len(u.Rents) > 0 {
+		return u.Rents
+	}
+	return []Rent_point{{Rent: u.Unit.Rent, At: u.FirstSeen}}
+}
+
+func peak(rents []Rent_point) float64 {
+	highest := 0.0
+	for _, p := range rents {
+		highest = max(highest, p.Rent)
+	}
+	return highest
+}
+
+type snapshot struct {
+	ListingName string
+	TakenAt     time.Time
+	Units       map[string]unit_state
+	Gone        map[string]unit_state // units off the listing for less than gone_kept, LastSeen is when they went
+}
+
+// floor plan name + unit number, the closest thing to a stable id apartments.com gives us
+func Unit_key(apt utils.Apartments) string {
+	return fmt.Sprintf("%s#%s", apt.Name, apt.UnitNumber)
+}
+
+type History struct {
+	store *store.Store
+}
+
+func New(s *store.Store) *History {
+	return &History{store: s}
+}
+
+// Record saves units as watch_id's latest snapshot of listing_url and returns how they differ from that watch's
+// previous one. every watch keeps its own, so another watch (or a one-off check) on the same listing seeing a
+// change first doesn't use it up. a watch without a snapshot yet starts from the listing's last recorded scrape
+func (h *History) Record(watch_id string, listing_url string, listing_name string, units []utils.Apartments) (Diff, error) {
+	prev, found, err := h.get(watch_key(watch_id))
+	if err == nil && !found {
+		prev, found, err = h.latest(listing_url)
+	}
+	if err != nil {
+		return Diff{}, err
+	}
+
+	diff, next := compare(prev, found, listing_name, units, time.Now())
+	if err := h.store.Put(bucket, watch_key(watch_id), next); err != nil {
+		return diff, err
+	}
+	// the listing's last recorded scrape, for one-off checks, previews and new watches
+	if err := h.store.Put(bucket, utils.Canonical_url(listing_url), next); err != nil {
+		return diff, err
+	}
+	return diff, nil
+}
+
+func watch_key(watch_id string) string {
+	return "watch:" + watch_id
+}
+
+// Forget drops a deleted watch's snapshot, so a new watch with the same id doesn't diff against it
+func (h *History) Forget(watch_id string) error {
+	return h.store.Delete(bucket, watch_key(watch_id))
+}
+
+// Compare diffs units against the listing's last recorded scrape without saving anything, for one-off checks and previews
+func (h *History) Compare(listing_url string, units []utils.Apartments) (Diff, error) {
+	prev, found, err := h.latest(listing_url)
+	if err != nil {
+		return Diff{}, err
+	}
+
+	diff, _ := compare(prev, found, prev.ListingName, units, time.Now())
+	return diff, nil
+}
+
+// Latest is the last recorded scrape of listing_url, found is false if it was never recorded
+func (h *History) Latest(listing_url string) (listing_name string, units []utils.Apartments, taken_at time.Time, found bool, err error) {
+	prev, found, err := h.latest(listing_url)
+	if err != nil || !found {
+		return "", nil, time.Time{}, found, err
+	}
+
+	for _, state := range prev.Units {
+		units = append(units, state.Unit)
+	}
+	sort.Slice(units, func(i, j int) bool { return Unit_key(units[i]) < Unit_key(units[j]) })
+	return prev.ListingName, units, prev.TakenAt, true, nil
+}
+
+func (h *History) latest(listing_url string) (snapshot, bool, error) {
+	return h.get(utils.Canonical_url(listing_url))
+}
+
+func (h *History) get(key string) (snapshot, bool, error) {
+	var prev snapshot
+	found, err := h.store.Get(bucket, key, &prev)
+	return prev, found, err
+}
+
+func compare(prev snapshot, found bool, listing_name string, units []utils.Apartments, now time.Time) (Diff, snapshot) {
+	diff := Diff{First: !found, Changes: make(map[string]Change)}
+	next := snapshot{ListingName: listing_name, TakenAt: now, Units: make(map[string]unit_state), Gone: make(map[string]unit_state)}
+
+	for _, apt := range units {
+		unit_key := Unit_key(apt)
+		state := unit_state{Unit: apt, FirstSeen: now, LastSeen: now, Rents: []Rent_point{{Rent: apt.Rent, At: now}}}
+
+		old, seen := prev.Units[unit_key]
+		// a unit that went and came back within gone_kept picks up its history where it left off
+		gone, relisted := prev.Gone[unit_key]
+		if !seen && relisted {
+			old = gone
+		}
+		var rents []Rent_point
+		if seen || relisted {
+			rents = old.rents()
+		}
+		highest := peak(rents)
+
+		switch {
+		case !seen && relisted:
+			// back on the market is news, but a drop from its old peak still counts
+			diff.Changes[unit_key] = Change{Kind: Added, Unit: apt, OldRent: old.Unit.Rent, Peak: highest}
+		case !seen:
+			diff.Changes[unit_key] = Change{Kind: Added, Unit: apt}
+		case apt.Rent < old.Unit.Rent:
+			diff.Changes[unit_key] = Change{Kind: PriceDrop, Unit: apt, OldRent: old.Unit.Rent, Peak: highest}
+		case apt.Rent > old.Unit.Rent:
+			diff.Changes[unit_key] = Change{Kind: PriceUp, Unit: apt, OldRent: old.Unit.Rent, Peak: highest}
+		default:
+			diff.Changes[unit_key] = Change{Kind: Unchanged, Unit: apt, OldRent: old.Unit.Rent, Peak: highest}
+		}
+
+		if seen || relisted {
+			state.FirstSeen = old.FirstSeen
+			state.Rents = rents
+			if apt.Rent != old.Unit.Rent {
+				state.Rents = append(state.Rents, Rent_point{Rent: apt.Rent, At: now})
+			}
+			state.Rents = state.Rents[max(0, len(state.Rents)-rents_kept):]
+		}
+		next.Units[unit_key] = state
+	}
+
+	for unit_key, old := range prev.Units {
+		if _, still := next.Units[unit_key]; !still {
+			diff.Removed = append(diff.Removed, Change{Kind: Removed, Unit: old.Unit, OldRent: old.Unit.Rent, Peak: peak(old.rents())})
+			next.Gone[unit_key] = old
+		}
+	}
+	for unit_key, gone := range prev.Gone {
+		_, back := next.Units[unit_key]
+		if !back && now.Sub(gone.LastSeen) < gone_kept {
+			next.Gone[unit_key] = gone
+		}
+	}
+	sort.Slice(diff.Removed, func(i, j int) bool { return Unit_key(diff.Removed[i].Unit) < Unit_key(diff.Removed[j].Unit) })
+
+	return diff, next
+}
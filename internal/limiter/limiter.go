@@ -0,0 +1,150 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// returned when a host already has too many scrapes waiting for a slot (mapped to 429 by the handlers)
+var ErrQueueFull = errors.New("rate limit queue full")
+
+// returned when a slot would not free up before MaxWait runs out
+var ErrMaxWait = errors.New("rate limit wait exceeded")
+
+type Config struct {
+	RequestsPerMinute float64
+	Burst             int
+	MinSpacing        time.Duration
+	Jitter            time.Duration
+	MaxQueue          int
+	MaxWait           time.Duration
+}
+
+// conservative defaults, apartments.com starts blocking well before this
+func Default_config() Config {
+	return Config{
+		RequestsPerMinute: 12,
+		Burst:             2,
+		MinSpacing:        2 * time.Second,
+		Jitter:            3 * time.Second,
+		MaxQueue:          10,
+		MaxWait:           90 * time.Second,
+	}
+}
+
+type bucket struct {
+	mu           sync.Mutex
+	tokens       float64
+	last_refill  time.Time
+	next_allowed time.Time
+	waiting      int
+}
+
+// Limiter is a token bucket per provider host with a minimum (jittered) gap between requests
+type Limiter struct {
+	cfg     Config
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func New(cfg Config) *Limiter {
+	if cfg.Burst < 1 {
+		cfg.Burst = 1
+	}
+	// without any wait or queue every request that has to queue would fail straight away with a 429
+	if cfg.MaxWait <= 0 {
+		cfg.MaxWait = Default_config().MaxWait
+	}
+	if cfg.MaxQueue <= 0 {
+		cfg.MaxQueue = Default_config().MaxQueue
+	}
+	return &Limiter{cfg: cfg, buckets: make(map[string]*bucket)}
+}
+
+func (l *Limiter) bucket_for(host string) *bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[host]
+	if !ok {
+		b = &bucket{tokens: float64(l.cfg.Burst), last_refill: time.Now()}
+		l.buckets[host] = b
+	}
+	return b
+}
+
+// try takes a token if one is free and the spacing has passed, otherwise reports how long to wait
+func (l *Limiter) try(b *bucket, now time.Time) time.Duration {
+	per_second := l.cfg.RequestsPerMinute / 60
+
+	b.tokens += now.Sub(b.last_refill).Seconds() * per_second
+	if b.tokens > float64(l.cfg.Burst) {
+		b.tokens = float64(l.cfg.Burst)
+	}
+	b.last_refill = now
+
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / per_second * float64(time.Second))
+	}
+	if gap := b.next_allowed.Sub(now); gap > wait {
+		wait = gap
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	b.tokens--
+	spacing := l.cfg.MinSpacing
+	if l.cfg.Jitter > 0 {
+		spacing += time.Duration(rand.Int63n(int64(l.cfg.Jitter)))
+	}
+	b.next_allowed = now.Add(spacing)
+	return 0
+}
+
+// Wait blocks until a request to host is allowed, the queue is full, MaxWait runs out or ctx is done
+func (l *Limiter) Wait(ctx context.Context, host string) error {
+	b := l.bucket_for(host)
+
+	b.mu.Lock()
+	if b.waiting >= l.cfg.MaxQueue {
+		b.mu.Unlock()
+		return fmt.Errorf("%w: %d requests already waiting for %s", ErrQueueFull, l.cfg.MaxQueue, host)
+	}
+	b.waiting++
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.waiting--
+		b.mu.Unlock()
+	}()
+
+	deadline := time.Now().Add(l.cfg.MaxWait)
+
+	for {
+		b.mu.Lock()
+		wait := l.try(b, time.Now())
+		b.mu.Unlock()
+
+		if wait == 0 {
+			return nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("%w: no slot for %s within %s", ErrMaxWait, host, l.cfg.MaxWait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	digest "github.com/anthonybliss1/go-apts/internal/digest"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+	store "github.com/anthonybliss1/go-apts/internal/store"
+)
+
+const digest_bucket = "digest_queue"
+
+// policy for a channel when the watch doesn't set one, main points it at notifiers.delivery
+var Default_delivery = func(channel string) digest.Policy { return digest.Policy{} }
+
+// Delivery_policy is when channel sends alert: the watch's policy for the channel, its "default",
+// then Default_delivery
+func Delivery_policy(alert Alert, channel string) digest.Policy {
+	if p, ok := alert.Delivery[channel]; ok {
+		return p
+	}
+	if p, ok := alert.Delivery[Template_default]; ok {
+		return p
+	}
+	return Default_delivery(channel)
+}
+
+// queued alerts for one channel and destination, sent together once the policy says so
+type queued struct {
+	Channel string
+	Target  string // the channel's target on the queued alerts, alerts for other targets queue separately
+	Policy  digest.Policy
+	Since   time.Time // when the first alert was queued
+	Alerts  []Alert
+}
+
+type Digest_queue struct {
+	mu    sync.Mutex
+	store *store.Store
+}
+
+func New_digest_queue(s *store.Store) *Digest_queue {
+	return &Digest_queue{store: s}
+}
+
+func queue_key(channel string, target string) string {
+	return channel + "|" + target
+}
+
+// Add holds alert for channel until its policy is due
+func (q *Digest_queue) Add(channel string, policy digest.Policy, alert Alert) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	target := alert.Targets[channel]
+	key := queue_key(channel, target)
+
+	var entry queued
+	found, err := q.store.Get(digest_bucket, key, &entry)
+	if err != nil {
+		return err
+	}
+	if !found {
+		entry = queued{Channel: channel, Target: target, Since: time.Now()}
+	}
+
+	// the latest policy wins, so editing a watch applies to what's already waiting
+	entry.Policy = policy
+	entry.Alerts = append(entry.Alerts, alert)
+	return q.store.Put(digest_bucket, key, entry)
+}
+
+// Pending is how many alerts are waiting per channel
+func (q *Digest_queue) Pending() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pending := make(map[string]int)
+	for _, key := range q.store.Keys(digest_bucket) {
+		var entry queued
+		if found, err := q.store.Get(digest_bucket, key, &entry); err == nil && found {
+			pending[entry.Channel] += len(entry.Alerts)
+		}
+	}
+	return pending
+}
+
+// Flush sends every queue that's due as one digest through the outbox, which retries failed sends
+func (q *Digest_queue) Flush(ctx context.Context, now time.Time) {
+	q.mu.Lock()
+	var due []queued
+	for _, key := range q.store.Keys(digest_bucket) {
+		var entry queued
+		found, err := q.store.Get(digest_bucket, key, &entry)
+		if err != nil || !found {
+			continue
+		}
+		if entry.Policy.Due(entry.Since, now) {
+			due = append(due, entry)
+			// taken off before sending so alerts queued meanwhile start a new digest
+			if err := q.store.Delete(digest_bucket, key); err != nil {
+				log.Printf("digest: removing %s from the queue: %v\n", key, err)
+			}
+		}
+	}
+	q.mu.Unlock()
+
+	for _, entry := range due {
+		alert := Digest_alert(entry.Alerts, now)
+		if entry.Target != "" {
+			alert.Targets = map[string]string{entry.Channel: entry.Target}
+		}
+
+		// every flush is its own digest, the key only stops the same one going twice
+		key := fmt.Sprintf("digest:%s:%d", queue_key(entry.Channel, entry.Target), entry.Since.UnixNano())
+		out, duplicate, err := Outgoing.Enqueue(entry.Channel, alert, key)
+		if errors.Is(err, ErrPreviouslyFailed) {
+			log.Printf("digest: %d alerts for %s: %v\n", len(entry.Alerts), entry.Channel, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("digest: saving %d alerts for %s to the outbox: %v\n", len(entry.Alerts), entry.Channel, err)
+			for _, a := range entry.Alerts {
+				if err := q.Add(entry.Channel, entry.Policy, a); err != nil {
+					log.Printf("digest: re-queueing for %s: %v\n", entry.Channel, err)
+				}
+			}
+			continue
+		}
+		if duplicate {
+			continue
+		}
+		if err := Outgoing.Attempt(ctx, out); err != nil {
+			log.Printf("digest: sending %d alerts to %s: %v\n", len(entry.Alerts), entry.Channel, err)
+		}
+	}
+}
+
+// Digest_alert merges queued alerts into one digest alert, one part per listing
+func Digest_alert(alerts []Alert, now time.Time) Alert {
+	var order []string
+	by_listing := make(map[string][]Alert)
+	for i, a := range alerts {
+		key := utils.Canonical_url(a.ListingURL)
+		// rule alerts stay as they are, next to their listing's section
+		if a.Trigger != nil {
+			key = fmt.Sprintf("%s|rule:%d", key, i)
+		}
+		if _, seen := by_listing[key]; !seen {
+			order = append(order, key)
+		}
+		by_listing[key] = append(by_listing[key], a)
+	}
+
+	digest_alert := Alert{ListingName: "go-apts digest", ScrapedAt: now}
+	for _, key := range order {
+		digest_alert.Digest = append(digest_alert.Digest, merge_listing(by_listing[key]))
+	}
+	return digest_alert
+}
+
+// merge_listing is the latest scrape of a listing with what changed since before the first queued one
+func merge_listing(parts []Alert) Alert {
+	merged := parts[len(parts)-1]
+	merged.Diff = history.Diff{First: parts[0].Diff.First, Changes: make(map[string]history.Change)}
+
+	// the first thing each unit did in the window: added, or its rent going in
+	first := make(map[string]history.Change)
+	for _, part := range parts {
+		for key, change := range part.Diff.Changes {
+			if prev, seen := first[key]; !seen || (change.Kind == history.Added && prev.Kind != history.Added) {
+				first[key] = change
+			}
+		}
+	}
+
+	for _, apt := range merged.Units {
+		key := history.Unit_key(apt)
+		change := history.Change{Kind: history.Unchanged, Unit: apt}
+
+		if start, ok := first[key]; ok {
+			change.OldRent = start.OldRent
+			switch {
+			case start.Kind == history.Added:
+				change = history.Change{Kind: history.Added, Unit: apt}
+			case apt.Rent < start.OldRent:
+				change.Kind = history.PriceDrop
+			case apt.Rent > start.OldRent:
+				change.Kind = history.PriceUp
+			}
+		}
+		merged.Diff.Changes[key] = change
+	}
+
+	// gone by the end of the window, leaving out units that came and went inside it
+	removed := make(map[string]bool)
+	for _, part := range parts {
+		for _, change := range part.Diff.Removed {
+			key := history.Unit_key(change.Unit)
+			if _, still := merged.Diff.Changes[key]; still || removed[key] || first[key].Kind == history.Added {
+				continue
+			}
+			removed[key] = true
+			merged.Diff.Removed = append(merged.Diff.Removed, change)
+		}
+	}
+	return merged
+}
+
+// Render_digest is the text of a digest: per listing a summary line and only the units that changed
+func Render_digest(alert Alert) string {
+	var sections []string
+	changed := 0
+
+	for _, part := range alert.Digest {
+		name := part.ListingName
+		if name == "" {
+			name = "Listing"
+		}
+
+		if part.Trigger != nil {
+			changed++
+			section := Render_trigger(part)
+			if part.ListingURL != "" {
+				section += "\n" + part.ListingURL
+			}
+			sections = append(sections, section)
+			continue
+		}
+
+		var lines []string
+		for _, apt := range part.Units {
+			change := part.Diff.Change_for(apt)
+			if change.Kind == history.Unchanged {
+				continue
+			}
+			line := change_marker(change) + " " + Unit_line(apt)
+			if change.Kind == history.PriceDrop || change.Kind == history.PriceUp {
+				line += fmt.Sprintf(" (was %s)", currency(change.OldRent))
+			}
+			lines = append(lines, line)
+		}
+		for _, gone := range part.Diff.Removed {
+			lines = append(lines, change_marker(gone)+" "+Unit_line(gone.Unit))
+		}
+
+		summary := compact_summary(part)
+		if len(lines) == 0 {
+			summary += ", no changes"
+		} else {
+			changed++
+		}
+
+		section := fmt.Sprintf("🏢 %s: %s", name, summary)
+		if len(lines) > 0 {
+			section += "\n" + strings.Join(lines, "\n")
+		}
+		if part.ListingURL != "" {
+			section += "\n" + part.ListingURL
+		}
+		sections = append(sections, section)
+	}
+
+	header := fmt.Sprintf("🗞️ go-apts digest: %d listings, %d with changes", len(alert.Digest), changed)
+	return header + "\n\n" + strings.Join(sections, telegram_separator)
+}
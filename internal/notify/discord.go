@@ -0,0 +1,227 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	config "github.com/anthonybliss1/go-apts/internal/config"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+)
+
+// discord's limits per webhook message
+const (
+	discord_max_embeds = 10
+	discord_max_chars  = 6000
+	discord_retries    = 3
+)
+
+// embed colours, so new units and price drops stand out in the channel
+const (
+	discord_colour_new       = 0x2ECC71
+	discord_colour_drop      = 0xF1C40F
+	discord_colour_up        = 0xE74C3C
+	discord_colour_unchanged = 0x95A5A6
+)
+
+// Discord posts one embed per unit to a webhook
+type Discord struct {
+	WebhookURL string // global webhook, a watch can override it with Targets["discord"]
+	Client     *http.Client
+}
+
+func New_discord(c config.Discord) (*Discord, error) {
+	if c.WebhookURL == "" && !c.Enabled {
+		return nil, fmt.Errorf("discord webhook url not set")
+	}
+
+	return &Discord{WebhookURL: c.WebhookURL, Client: &http.Client{Timeout: 15 * time.Second}}, nil
+}
+
+func (d *Discord) Name() string { return "discord" }
+
+type discord_field struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discord_embed struct {
+	Title       string          `json:"title"`
+	URL         string          `json:"url,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Color       int             `json:"color"`
+	Fields      []discord_field `json:"fields,omitempty"`
+}
+
+// what discord counts towards the 6000 character limit
+func (e discord_embed) size() int {
+	n := len([]rune(e.Title)) + len([]rune(e.Description))
+	for _, f := range e.Fields {
+		n += len([]rune(f.Name)) + len([]rune(f.Value))
+	}
+	return n
+}
+
+type discord_message struct {
+	Content string          `json:"content,omitempty"`
+	Embeds  []discord_embed `json:"embeds,omitempty"`
+}
+
+func (d *Discord) Send(ctx context.Context, alert Alert) error {
+	webhook_url := d.WebhookURL
+	if target := alert.Targets[d.Name()]; target != "" {
+		webhook_url = target
+	}
+	if webhook_url == "" {
+		return utils.New_error(utils.ErrNotifier, "no discord webhook configured for this watch", nil)
+	}
+
+	messages := discord_messages(alert)
+	if text, ok := render_custom(alert, d.Name()); ok {
+		// a template replaces the embeds with plain message content
+		messages = []discord_message{{Content: truncate(text, 2000)}}
+	}
+
+	for i, msg := range messages {
+		// a long alert is several posts, an outbox retry picks up from the one that failed
+		msg_key := fmt.Sprintf("%s#%d", webhook_url, i)
+		if already_delivered(ctx, msg_key) {
+			continue
+		}
+		if err := d.post(ctx, webhook_url, msg); err != nil {
+			return err
+		}
+		mark_delivered(ctx, msg_key)
+	}
+	return nil
+}
+
+func discord_unit_embed(alert Alert, apt utils.Apartments) discord_embed {
+	unit := apt.UnitNumber
+	if unit == "" {
+		unit = apt.Name
+	}
+
+	embed := discord_embed{
+		Title: truncate(fmt.Sprintf("🏠 Unit %s", unit), 256),
+		URL:   alert.ListingURL,
+		Color: discord_colour_unchanged,
+		Fields: []discord_field{
+			{Name: "Rent", Value: fmt.Sprintf("$%.2f", apt.Rent), Inline: true},
+			{Name: "Beds / Baths", Value: fmt.Sprintf("%d bd | %.1f ba", apt.Beds, apt.Baths), Inline: true},
+			{Name: "Size", Value: fmt.Sprintf("%.0f sqft", apt.SquareFeet), Inline: true},
+			{Name: "Available", Value: truncate(or_dash(apt.AvailableDateText), 1024), Inline: true},
+		},
+	}
+
+	switch change := alert.Diff.Change_for(apt); change.Kind {
+	case history.Added:
+		embed.Color = discord_colour_new
+		embed.Description = "🆕 New unit"
+	case history.PriceDrop:
+		embed.Color = discord_colour_drop
+		embed.Description = fmt.Sprintf("📉 Price drop from $%.2f", change.OldRent)
+	case history.PriceUp:
+		embed.Color = discord_colour_up
+		embed.Description = fmt.Sprintf("📈 Up from $%.2f", change.OldRent)
+	}
+	return embed
+}
+
+// packs unit embeds into as few messages as discord allows (10 embeds and 6000 characters each)
+func discord_messages(alert Alert) []discord_message {
+	name := alert.ListingName
+	if name == "" {
+		name = "Listing"
+	}
+
+	if len(alert.Units) == 0 {
+		return []discord_message{{Content: fmt.Sprintf("No available units right now at **%s**\n<%s>", name, alert.ListingURL)}}
+	}
+
+	content := truncate(fmt.Sprintf("🚨 **%s** has %d available units", name, len(alert.Units)), 2000)
+
+	var messages []discord_message
+	current := discord_message{Content: content}
+	chars := 0
+
+	for _, apt := range alert.Units {
+		embed := discord_unit_embed(alert, apt)
+		if len(current.Embeds) == discord_max_embeds || (len(current.Embeds) > 0 && chars+embed.size() > discord_max_chars) {
+			messages = append(messages, current)
+			current = discord_message{}
+			chars = 0
+		}
+		current.Embeds = append(current.Embeds, embed)
+		chars += embed.size()
+	}
+	return append(messages, current)
+}
+
+func or_dash(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "-"
+	}
+	return s
+}
+
+// posts msg, waiting out discord's retry_after on a 429 a few times before giving up
+func (d *Discord) post(ctx context.Context, webhook_url string, msg discord_message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal discord payload: %w", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", webhook_url, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("building discord request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := d.Client.Do(req)
+		if err != nil {
+			return utils.New_error(utils.ErrNotifier, "send discord request", err)
+		}
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= discord_retries {
+			return &utils.Apts_error{Kind: utils.ErrNotifier, Detail: fmt.Sprintf("received status code %d from discord: %s", resp.StatusCode, strings.TrimSpace(string(reply))), Status: resp.StatusCode}
+		}
+
+		timer := time.NewTimer(discord_retry_after(resp, reply))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// discord puts retry_after (seconds, can be fractional) in the body, Retry-After header as a fallback
+func discord_retry_after(resp *http.Response, reply []byte) time.Duration {
+	var rate_limit struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+	if err := json.Unmarshal(reply, &rate_limit); err == nil && rate_limit.RetryAfter > 0 {
+		return time.Duration(rate_limit.RetryAfter * float64(time.Second))
+	}
+	if secs, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil && secs > 0 {
+		return time.Duration(secs * float64(time.Second))
+	}
+	return time.Second
+}
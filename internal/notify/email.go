@@ -0,0 +1,356 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	config "github.com/anthonybliss1/go-apts/internal/config"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+)
+
+// how the connection to the SMTP server is secured
+const (
+	TLS_starttls = "starttls" // plain connect then upgrade, usually port 587
+	TLS_implicit = "implicit" // TLS from the first byte, usually port 465
+	TLS_none     = "none"     // local catchers (mailpit, mailhog) only
+)
+
+// Email sends a multipart text + HTML digest over SMTP
+type Email struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	To       []string // global recipients, a watch can replace them with Targets["email"] (comma separated)
+	TLS      string
+}
+
+func New_email(c config.Email) (*Email, error) {
+	if c.Host == "" {
+		return nil, fmt.Errorf("smtp host not set")
+	}
+	if c.From == "" {
+		return nil, fmt.Errorf("smtp from address not set")
+	}
+
+	port := c.Port
+	if port == "" {
+		port = "587"
+	}
+
+	tls_mode := strings.ToLower(c.TLS)
+	switch tls_mode {
+	case "":
+		tls_mode = TLS_starttls
+		if port == "465" {
+			tls_mode = TLS_implicit
+		}
+	case TLS_starttls, TLS_implicit, TLS_none:
+	default:
+		return nil, fmt.Errorf("tls must be starttls, implicit or none, got %q", tls_mode)
+	}
+
+	return &Email{
+		Host:     c.Host,
+		Port:     port,
+		Username: c.Username,
+		Password: c.Password,
+		From:     c.From,
+		To:       c.To,
+		TLS:      tls_mode,
+	}, nil
+}
+
+func (e *Email) Name() string { return "email" }
+
+func split_addresses(v string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(v, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (e *Email) Send(ctx context.Context, alert Alert) error {
+	to := e.To
+	if target := alert.Targets[e.Name()]; target != "" {
+		to = split_addresses(target)
+	}
+	if len(to) == 0 {
+		return utils.New_error(utils.ErrNotifier, "no email recipients configured for this watch", nil)
+	}
+
+	msg, err := e.build_message(alert, to)
+	if err != nil {
+		return err
+	}
+
+	if err := e.deliver(ctx, to, msg); err != nil {
+		return utils.New_error(utils.ErrNotifier, "send email", err)
+	}
+	return nil
+}
+
+type email_row struct {
+	Unit        string
+	BedsBaths   string
+	Rent        string
+	PerSqft     string
+	Size        string
+	Available   string
+	Change      string
+	ChangeColor string
+}
+
+type email_listing struct {
+	Name       string
+	ListingURL string
+	Count      int
+	Rows       []email_row
+	ScrapedAt  string
+}
+
+// one listing for an alert, one per listing for a digest
+type email_view struct {
+	Listings []email_listing
+}
+
+var email_html = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: -apple-system, Helvetica, Arial, sans-serif; color: #222;">
+  {{range .Listings}}
+  <h2 style="margin-bottom: 4px;">🚨 {{.Name}}</h2>
+  {{if .Rows}}
+  <p style="margin-top: 0;">{{.Count}} available units as of {{.ScrapedAt}}</p>
+  <table cellpadding="6" cellspacing="0" style="border-collapse: collapse; font-size: 14px;">
+    <tr style="background: #f0f0f0; text-align: left;">
+      <th>Unit</th><th>Beds / Baths</th><th>Rent</th><th>$/sqft</th><th>Size</th><th>Available</th><th></th>
+    </tr>
+    {{$listing_url := .ListingURL}}{{range .Rows}}
+    <tr style="border-top: 1px solid #ddd;">
+      <td><a href="{{$listing_url}}">{{.Unit}}</a></td><td>{{.BedsBaths}}</td><td>{{.Rent}}</td><td>{{.PerSqft}}</td><td>{{.Size}}</td><td>{{.Available}}</td>
+      <td style="color: {{.ChangeColor}};">{{.Change}}</td>
+    </tr>
+    {{end}}
+  </table>
+  {{else}}
+  <p>No available units right now.</p>
+  {{end}}
+  <p><a href="{{.ListingURL}}">View listing</a></p>
+  {{end}}
+</body>
+</html>
+`))
+
+func email_rows(alert Alert) []email_row {
+	var rows []email_row
+	for _, apt := range alert.Units {
+		unit := apt.UnitNumber
+		if unit == "" {
+			unit = apt.Name
+		}
+
+		row := email_row{
+			Unit:      unit,
+			BedsBaths: fmt.Sprintf("%d bd / %.1f ba", apt.Beds, apt.Baths),
+			Rent:      fmt.Sprintf("$%.2f", apt.Rent),
+			PerSqft:   "-",
+			Size:      fmt.Sprintf("%.0f sqft", apt.SquareFeet),
+			Available: or_dash(apt.AvailableDateText),
+		}
+		if apt.SquareFeet > 0 {
+			row.PerSqft = fmt.Sprintf("$%.2f", apt.Rent/apt.SquareFeet)
+		}
+
+		switch change := alert.Diff.Change_for(apt); change.Kind {
+		case history.Added:
+			row.Change, row.ChangeColor = "new", "#2e7d32"
+		case history.PriceDrop:
+			row.Change, row.ChangeColor = fmt.Sprintf("↓ from $%.2f", change.OldRent), "#b8860b"
+		case history.PriceUp:
+			row.Change, row.ChangeColor = fmt.Sprintf("↑ from $%.2f", change.OldRent), "#c62828"
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func email_listings(alert Alert) []Alert {
+	if len(alert.Digest) > 0 {
+		return alert.Digest
+	}
+	return []Alert{alert}
+}
+
+func (e *Email) build_message(alert Alert, to []string) ([]byte, error) {
+	name := alert.ListingName
+	if name == "" {
+		name = "Listing"
+	}
+
+	var html_body bytes.Buffer
+	var view email_view
+	for _, listing := range email_listings(alert) {
+		listing_name := listing.ListingName
+		if listing_name == "" {
+			listing_name = "Listing"
+		}
+		view.Listings = append(view.Listings, email_listing{
+			Name:       listing_name,
+			ListingURL: listing.ListingURL,
+			Count:      len(listing.Units),
+			Rows:       email_rows(listing),
+			ScrapedAt:  listing.ScrapedAt.Format("Jan 2 2006 15:04"),
+		})
+	}
+	if err := email_html.Execute(&html_body, view); err != nil {
+		return nil, fmt.Errorf("rendering email html: %w", err)
+	}
+
+	// a template only replaces the text part, the html table stays as is
+	text, ok := render_custom(alert, e.Name())
+	if !ok {
+		text = Render_text(alert)
+	}
+	text_body := strings.TrimSpace(text) + "\n\n" + alert.ListingURL + "\n"
+
+	subject := fmt.Sprintf("go-apts: %d available units at %s", len(alert.Units), name)
+	switch {
+	case len(alert.Digest) > 0:
+		subject = fmt.Sprintf("go-apts digest: %d listings", len(alert.Digest))
+		text_body = strings.TrimSpace(text) + "\n"
+	case alert.Trigger != nil:
+		subject = "go-apts: " + Trigger_title(alert)
+	case len(alert.Units) == 0:
+		subject = fmt.Sprintf("go-apts: no available units at %s", name)
+	}
+
+	var msg bytes.Buffer
+	writer := multipart.NewWriter(&msg)
+
+	headers := []string{
+		"From: " + e.From,
+		"To: " + strings.Join(to, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: " + message_id(e.From),
+		"MIME-Version: 1.0",
+		fmt.Sprintf("Content-Type: multipart/alternative; boundary=%q", writer.Boundary()),
+	}
+	msg.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	parts := []struct {
+		content_type string
+		body         string
+	}{
+		{"text/plain; charset=utf-8", text_body},
+		{"text/html; charset=utf-8", html_body.String()},
+	}
+	for _, p := range parts {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.content_type},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("building email part: %w", err)
+		}
+		part.Write([]byte(strings.ReplaceAll(p.body, "\n", "\r\n")))
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("closing email body: %w", err)
+	}
+
+	return msg.Bytes(), nil
+}
+
+func message_id(from string) string {
+	domain := "go-apts.local"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = strings.Trim(from[at+1:], "> ")
+	}
+
+	b := make([]byte, 12)
+	rand.Read(b)
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), domain)
+}
+
+func (e *Email) deliver(ctx context.Context, to []string, msg []byte) error {
+	addr := net.JoinHostPort(e.Host, e.Port)
+	tls_config := &tls.Config{ServerName: e.Host}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if e.TLS == TLS_implicit {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tls_config}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+
+	// net/smtp doesn't take a context, so bound the whole conversation instead
+	deadline := time.Now().Add(30 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	client, err := smtp.NewClient(conn, e.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("starting smtp session: %w", err)
+	}
+	defer client.Close()
+
+	if e.TLS == TLS_starttls {
+		if err := client.StartTLS(tls_config); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+
+	if e.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", e.Username, e.Password, e.Host)); err != nil {
+			return fmt.Errorf("smtp auth: %w", err)
+		}
+	}
+
+	if err := client.Mail(e.From); err != nil {
+		return fmt.Errorf("MAIL FROM: %w", err)
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("RCPT TO %s: %w", rcpt, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("DATA: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("writing message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("finishing message: %w", err)
+	}
+
+	return client.Quit()
+}
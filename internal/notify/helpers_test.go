@@ -0,0 +1,45 @@
+package notify
+
+import (
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+	rules "github.com/anthonybliss1/go-apts/internal/rules"
+)
+
+// alerts the tests share. they all use the same watch and scrape time so outbox keys and event ids are stable
+func test_alert(url string) Alert {
+	return Alert{ListingURL: url, WatchID: "home", ScrapedAt: time.Date(2025, 5, 1, 14, 0, 0, 0, time.UTC)}
+}
+
+// a scrape with one of each kind of change
+func changed_alert() Alert {
+	added := utils.Apartments{Name: "A1", UnitNumber: "101", Beds: 1, Rent: 1500}
+	dropped := utils.Apartments{Name: "B2", UnitNumber: "204", Beds: 2, Rent: 1650}
+	same := utils.Apartments{Name: "B2", UnitNumber: "305", Beds: 2, Rent: 1900}
+	gone := utils.Apartments{Name: "S", UnitNumber: "001", Rent: 1200}
+
+	alert := test_alert("https://www.apartments.com/example/")
+	alert.ListingName = "The Example"
+	alert.Units = []utils.Apartments{added, dropped, same}
+	alert.Diff = history.Diff{
+		Changes: map[string]history.Change{
+			history.Unit_key(added):   {Kind: history.Added, Unit: added},
+			history.Unit_key(dropped): {Kind: history.PriceDrop, Unit: dropped, OldRent: 1725, Peak: 1725},
+			history.Unit_key(same):    {Kind: history.Unchanged, Unit: same, OldRent: 1900, Peak: 1900},
+		},
+		Removed: []history.Change{{Kind: history.Removed, Unit: gone, OldRent: 1200}},
+	}
+	return alert
+}
+
+// a high priority rule firing, the only kind of alert sms sends
+func rule_alert(priority string) Alert {
+	unit := utils.Apartments{Name: "A1", UnitNumber: "204", Beds: 1, Rent: 1650}
+	alert := test_alert("https://www.apartments.com/example/")
+	alert.ListingName = "The Example"
+	alert.Units = []utils.Apartments{unit}
+	alert.Trigger = &rules.Trigger{Rule: rules.Rule{Type: rules.Under_target, Priority: priority}, Unit: unit, Target: 1800}
+	return alert
+}
@@ -0,0 +1,286 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	config "github.com/anthonybliss1/go-apts/internal/config"
+)
+
+// units per matrix message, homeservers reject events over 64KiB
+const matrix_units_per_message = 25
+
+// tries per message when the homeserver rate limits us
+const matrix_attempts = 3
+
+type Matrix struct {
+	Homeserver  string   // https://matrix.example.org, or a local stand-in
+	AccessToken string   // the bot account's token
+	Rooms       []string // room ids (!abc:example.org) or aliases (#apts:example.org), a watch can pick others with Targets["matrix"]
+	Client      *http.Client
+
+	mu       sync.Mutex
+	room_ids map[string]string // resolved aliases
+}
+
+func New_matrix(c config.Matrix) (*Matrix, error) {
+	if c.Homeserver == "" {
+		return nil, fmt.Errorf("matrix homeserver not set")
+	}
+	if c.AccessToken == "" {
+		return nil, fmt.Errorf("matrix access token not set")
+	}
+
+	return &Matrix{
+		Homeserver:  strings.TrimRight(c.Homeserver, "/"),
+		AccessToken: c.AccessToken,
+		Rooms:       c.Rooms,
+		Client:      &http.Client{Timeout: 15 * time.Second},
+		room_ids:    make(map[string]string),
+	}, nil
+}
+
+func (m *Matrix) Name() string { return "matrix" }
+
+type matrix_message struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+}
+
+// matrix_error is the homeserver's error body, e.g. {"errcode": "M_FORBIDDEN", "error": "..."}
+type matrix_error struct {
+	ErrCode      string `json:"errcode"`
+	Error        string `json:"error"`
+	RetryAfterMs int    `json:"retry_after_ms"`
+}
+
+func matrix_html_message(text string, formatted string) matrix_message {
+	return matrix_message{MsgType: "m.text", Body: text, Format: "org.matrix.custom.html", FormattedBody: formatted}
+}
+
+// template, digest and rule alert text keeps its line breaks in the html version
+func matrix_text_message(text string, listing_url string) matrix_message {
+	formatted := strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+	if listing_url != "" {
+		text += "\n" + listing_url
+		formatted += fmt.Sprintf(`<br><a href="%s">Open listing</a>`, html.EscapeString(listing_url))
+	}
+	return matrix_html_message(text, formatted)
+}
+
+func matrix_unit_html(alert Alert, apt utils.Apartments) string {
+	change := alert.Diff.Change_for(apt)
+
+	title := "<b>Unit " + html.EscapeString(unit_label(apt)) + "</b>"
+	if marker := arrow(change); marker != "" {
+		title += " " + marker
+	}
+	rent := currency(apt.Rent)
+	if diff := price_diff(change); diff != "" {
+		rent += " (" + diff + ")"
+	}
+
+	return fmt.Sprintf("<p>%s<br>🛏️ %d Bed | 🛁 %.1f Bath<br>💰 %s | 📏 %.0f sqft<br>🗓️ %s</p>",
+		title, apt.Beds, apt.Baths, rent, apt.SquareFeet, html.EscapeString(apt.AvailableDateText))
+}
+
+// matrix_messages is the alert as html, split every matrix_units_per_message units
+func matrix_messages(alert Alert) []matrix_message {
+	if text, ok := render_custom(alert, "matrix"); ok {
+		return []matrix_message{matrix_text_message(text, alert.ListingURL)}
+	}
+
+	name := alert.ListingName
+	if name == "" {
+		name = "Listing"
+	}
+	if len(alert.Units) == 0 {
+		return []matrix_message{matrix_text_message(strings.TrimSpace(Render_text(alert)), alert.ListingURL)}
+	}
+
+	var messages []matrix_message
+	for start := 0; start < len(alert.Units); start += matrix_units_per_message {
+		units := alert.Units[start:min(start+matrix_units_per_message, len(alert.Units))]
+
+		chunk := alert
+		chunk.Units = units
+		text := strings.TrimSpace(Render_text(chunk))
+
+		header := fmt.Sprintf("🚨 %s Alert 🚨", name)
+		if start > 0 {
+			header = fmt.Sprintf("🚨 %s Alert (cont.)", name)
+		}
+		formatted := "<h4>" + html.EscapeString(header) + "</h4>"
+		for _, apt := range units {
+			formatted += matrix_unit_html(alert, apt)
+		}
+
+		if alert.ListingURL != "" {
+			text += "\n" + alert.ListingURL
+			formatted += fmt.Sprintf(`<p><a href="%s">Open listing</a></p>`, html.EscapeString(alert.ListingURL))
+		}
+		messages = append(messages, matrix_html_message(text, formatted))
+	}
+	return messages
+}
+
+// matrix_txn_id is the same for the same message of the same alert to the same room, so when the outbox
+// retries a send that did get through the homeserver drops the repeat instead of posting it twice
+func matrix_txn_id(room string, alert Alert, part int) string {
+	b, _ := json.Marshal(struct {
+		Room      string
+		URL       string
+		WatchID   string
+		ScrapedAt int64
+		Digest    int
+		Trigger   any
+		Part      int
+	}{room, alert.ListingURL, alert.WatchID, alert.ScrapedAt.UnixNano(), len(alert.Digest), alert.Trigger, part})
+	sum := sha256.Sum256(b)
+	return "go-apts-" + hex.EncodeToString(sum[:16])
+}
+
+func (m *Matrix) Send(ctx context.Context, alert Alert) error {
+	rooms := m.Rooms
+	if target := alert.Targets[m.Name()]; target != "" {
+		rooms = split_addresses(target)
+	}
+	if len(rooms) == 0 {
+		return utils.New_error(utils.ErrNotifier, "no matrix rooms configured for this watch", nil)
+	}
+
+	messages := matrix_messages(alert)
+
+	// one room failing (bot kicked, room gone) shouldn't stop the rest
+	var errs []error
+	for _, room := range rooms {
+		if err := m.send_room(ctx, room, alert, messages); err != nil {
+			if len(rooms) > 1 {
+				err = fmt.Errorf("room %s: %w", room, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *Matrix) send_room(ctx context.Context, room string, alert Alert, messages []matrix_message) error {
+	room_id, err := m.room_id(ctx, room)
+	if err != nil {
+		return err
+	}
+
+	for i, msg := range messages {
+		endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+			m.Homeserver, url.PathEscape(room_id), url.PathEscape(matrix_txn_id(room_id, alert, i)))
+		if err := m.call(ctx, "PUT", endpoint, msg, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// room_id resolves an alias through the room directory, ids are used as they are
+func (m *Matrix) room_id(ctx context.Context, room string) (string, error) {
+	if !strings.HasPrefix(room, "#") {
+		return room, nil
+	}
+
+	m.mu.Lock()
+	id, ok := m.room_ids[room]
+	m.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	var resolved struct {
+		RoomID string `json:"room_id"`
+	}
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/directory/room/%s", m.Homeserver, url.PathEscape(room))
+	if err := m.call(ctx, "GET", endpoint, nil, &resolved); err != nil {
+		return "", fmt.Errorf("resolving %s: %w", room, err)
+	}
+
+	m.mu.Lock()
+	if m.room_ids == nil {
+		m.room_ids = make(map[string]string)
+	}
+	m.room_ids[room] = resolved.RoomID
+	m.mu.Unlock()
+	return resolved.RoomID, nil
+}
+
+// call makes a client-server API request, waiting out rate limits (the txn id makes a resend safe)
+func (m *Matrix) call(ctx context.Context, method string, endpoint string, payload any, out any) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return fmt.Errorf("marshal matrix payload: %w", err)
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("building matrix request: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+m.AccessToken)
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := m.Client.Do(req)
+		if err != nil {
+			return utils.New_error(utils.ErrNotifier, "send matrix request", err)
+		}
+		resp_body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			if out != nil {
+				if err := json.Unmarshal(resp_body, out); err != nil {
+					return utils.New_error(utils.ErrNotifier, "decoding matrix response", err)
+				}
+			}
+			return nil
+		}
+
+		var merr matrix_error
+		json.Unmarshal(resp_body, &merr)
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < matrix_attempts {
+			wait := time.Duration(merr.RetryAfterMs) * time.Millisecond
+			if wait <= 0 {
+				wait = time.Second
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(min(wait, 30*time.Second)):
+			}
+			continue
+		}
+
+		detail := strings.TrimSpace(string(resp_body))
+		if merr.ErrCode != "" {
+			detail = merr.ErrCode + ": " + merr.Error
+		}
+		return &utils.Apts_error{Kind: utils.ErrNotifier, Detail: fmt.Sprintf("received status code %d from matrix: %s", resp.StatusCode, detail), Status: resp.StatusCode}
+	}
+}
@@ -0,0 +1,336 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	config "github.com/anthonybliss1/go-apts/internal/config"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// how long a connect or publish can take before the send fails (and the outbox retries it)
+const mqtt_timeout = 10 * time.Second
+
+// Mqtt publishes every scrape as retained per-watch state topics plus an events topic, and announces
+// the state as Home Assistant sensors through MQTT discovery
+type Mqtt struct {
+	Broker          string // tcp://localhost:1883, ssl://... or ws://...
+	Username        string
+	Password        string
+	ClientID        string
+	Prefix          string // topics are <Prefix>/<watch>/..., a watch can use another prefix with Targets["mqtt"]
+	DiscoveryPrefix string // home assistant's discovery prefix, empty to not announce sensors
+
+	mu        sync.Mutex
+	client    paho.Client
+	announced map[string]bool // discovery configs already sent by this process
+}
+
+func New_mqtt(c config.Mqtt) (*Mqtt, error) {
+	if c.Broker == "" {
+		return nil, fmt.Errorf("mqtt broker not set")
+	}
+
+	m := &Mqtt{
+		Broker:          c.Broker,
+		Username:        c.Username,
+		Password:        c.Password,
+		ClientID:        c.ClientID,
+		Prefix:          strings.Trim(c.TopicPrefix, "/"),
+		DiscoveryPrefix: strings.Trim(c.DiscoveryPrefix, "/"),
+		announced:       make(map[string]bool),
+	}
+	if m.ClientID == "" {
+		m.ClientID = "go-apts"
+	}
+	if m.Prefix == "" {
+		m.Prefix = "go-apts"
+	}
+	if m.DiscoveryPrefix == "" {
+		m.DiscoveryPrefix = "homeassistant"
+	}
+	if !c.Discovery {
+		m.DiscoveryPrefix = ""
+	}
+	return m, nil
+}
+
+func (m *Mqtt) Name() string { return "mqtt" }
+
+// <Prefix>/status is "online" while go-apts is connected, the broker sets it to "offline" when it goes away
+func (m *Mqtt) status_topic() string {
+	return m.Prefix + "/status"
+}
+
+// connect opens the connection on the first send, paho reconnects by itself after that
+func (m *Mqtt) connect() (paho.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.client != nil && m.client.IsConnectionOpen() {
+		return m.client, nil
+	}
+
+	if m.client == nil {
+		status := m.status_topic()
+		opts := paho.NewClientOptions().
+			AddBroker(m.Broker).
+			SetClientID(m.ClientID).
+			SetUsername(m.Username).
+			SetPassword(m.Password).
+			SetAutoReconnect(true).
+			SetConnectTimeout(mqtt_timeout).
+			SetWill(status, "offline", 1, true).
+			SetOnConnectHandler(func(c paho.Client) {
+				c.Publish(status, 1, true, "online")
+			})
+		m.client = paho.NewClient(opts)
+	}
+
+	token := m.client.Connect()
+	if !token.WaitTimeout(mqtt_timeout) {
+		return nil, utils.New_error(utils.ErrNotifier, "connecting to mqtt broker "+m.Broker+": timed out", nil)
+	}
+	if err := token.Error(); err != nil {
+		return nil, utils.New_error(utils.ErrNotifier, "connecting to mqtt broker "+m.Broker, err)
+	}
+	return m.client, nil
+}
+
+type mqtt_message struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+// Mqtt_state is the JSON on <prefix>/<watch>/state, home assistant shows it as the sensors' attributes
+type Mqtt_state struct {
+	ListingName    string             `json:"listing_name"`
+	ListingURL     string             `json:"listing_url"`
+	WatchID        string             `json:"watch_id,omitempty"`
+	AvailableUnits int                `json:"available_units"`
+	CheapestRent   *float64           `json:"cheapest_rent"`
+	CheapestUnit   string             `json:"cheapest_unit,omitempty"`
+	CheapestByBeds map[string]float64 `json:"cheapest_by_beds"` // "0" for studios
+	NewUnits       int                `json:"new_units"`
+	PriceDrops     int                `json:"price_drops"`
+	RemovedUnits   int                `json:"removed_units"`
+	LastChecked    time.Time          `json:"last_checked"`
+}
+
+func mqtt_state(alert Alert) Mqtt_state {
+	state := Mqtt_state{
+		ListingName:    alert.ListingName,
+		ListingURL:     alert.ListingURL,
+		WatchID:        alert.WatchID,
+		AvailableUnits: len(alert.Units),
+		CheapestByBeds: make(map[string]float64),
+		RemovedUnits:   len(alert.Diff.Removed),
+		LastChecked:    alert.ScrapedAt.UTC(),
+	}
+
+	for _, apt := range alert.Units {
+		switch alert.Diff.Change_for(apt).Kind {
+		case history.Added:
+			state.NewUnits++
+		case history.PriceDrop:
+			state.PriceDrops++
+		}
+
+		if apt.Rent <= 0 {
+			continue
+		}
+		if state.CheapestRent == nil || apt.Rent < *state.CheapestRent {
+			rent := apt.Rent
+			state.CheapestRent = &rent
+			state.CheapestUnit = unit_label(apt)
+		}
+		beds := strconv.Itoa(apt.Beds)
+		if cheapest, ok := state.CheapestByBeds[beds]; !ok || apt.Rent < cheapest {
+			state.CheapestByBeds[beds] = apt.Rent
+		}
+	}
+	return state
+}
+
+// mqtt_key is the topic level for a watch, one-off checks use the listing's id
+func mqtt_key(alert Alert) string {
+	if alert.WatchID != "" {
+		return alert.WatchID
+	}
+	return alert.ListingID
+}
+
+// mqtt_sensor is a home assistant discovery config, see https://www.home-assistant.io/integrations/sensor.mqtt/
+type mqtt_sensor struct {
+	Name                string            `json:"name"`
+	UniqueID            string            `json:"unique_id"`
+	StateTopic          string            `json:"state_topic"`
+	JSONAttributesTopic string            `json:"json_attributes_topic"`
+	AvailabilityTopic   string            `json:"availability_topic"`
+	UnitOfMeasurement   string            `json:"unit_of_measurement,omitempty"`
+	DeviceClass         string            `json:"device_class,omitempty"`
+	StateClass          string            `json:"state_class,omitempty"`
+	Icon                string            `json:"icon,omitempty"`
+	Device              map[string]any    `json:"device"`
+	Origin              map[string]string `json:"origin"`
+}
+
+// the retained per-field topics, and how home assistant should show them
+var mqtt_sensors = []struct {
+	field        string
+	name         string
+	unit         string
+	device_class string
+	state_class  string
+	icon         string
+}{
+	{"available_units", "Available units", "units", "", "measurement", "mdi:home-city"},
+	{"cheapest_rent", "Cheapest rent", "USD", "monetary", "", "mdi:cash"},
+	{"last_checked", "Last checked", "", "timestamp", "", ""},
+}
+
+func (m *Mqtt) discovery(prefix string, key string, state Mqtt_state) []mqtt_message {
+	if m.DiscoveryPrefix == "" {
+		return nil
+	}
+
+	name := state.ListingName
+	if name == "" {
+		name = "Listing " + key
+	}
+	object := "go_apts_" + key
+
+	var messages []mqtt_message
+	for _, s := range mqtt_sensors {
+		config := mqtt_sensor{
+			Name:                s.name,
+			UniqueID:            object + "_" + s.field,
+			StateTopic:          fmt.Sprintf("%s/%s/%s", prefix, key, s.field),
+			JSONAttributesTopic: fmt.Sprintf("%s/%s/state", prefix, key),
+			AvailabilityTopic:   m.status_topic(),
+			UnitOfMeasurement:   s.unit,
+			DeviceClass:         s.device_class,
+			StateClass:          s.state_class,
+			Icon:                s.icon,
+			Device: map[string]any{
+				"identifiers":       []string{object},
+				"name":              name,
+				"manufacturer":      "go-apts",
+				"configuration_url": state.ListingURL,
+			},
+			Origin: map[string]string{"name": "go-apts"},
+		}
+		b, _ := json.Marshal(config)
+		topic := fmt.Sprintf("%s/sensor/%s/%s/config", m.DiscoveryPrefix, object, s.field)
+		messages = append(messages, mqtt_message{topic: topic, payload: string(b), retained: true})
+	}
+	return messages
+}
+
+// mqtt_messages is what one alert publishes: retained state (not for rule alerts, which only have their unit)
+// and one event per change on <prefix>/<watch>/events, the same JSON the webhook channel posts
+func (m *Mqtt) mqtt_messages(alert Alert, prefix string) []mqtt_message {
+	if len(alert.Digest) > 0 {
+		var messages []mqtt_message
+		for _, part := range alert.Digest {
+			messages = append(messages, m.mqtt_messages(part, prefix)...)
+		}
+		return messages
+	}
+
+	key := mqtt_key(alert)
+	base := prefix + "/" + key
+	var messages []mqtt_message
+
+	if alert.Trigger == nil {
+		state := mqtt_state(alert)
+
+		cheapest := "None" // home assistant reads it as unknown
+		if state.CheapestRent != nil {
+			cheapest = strconv.FormatFloat(*state.CheapestRent, 'f', -1, 64)
+		}
+		b, _ := json.Marshal(state)
+
+		messages = append(messages, m.discovery(prefix, key, state)...)
+		messages = append(messages,
+			mqtt_message{topic: base + "/available_units", payload: strconv.Itoa(state.AvailableUnits), retained: true},
+			mqtt_message{topic: base + "/cheapest_rent", payload: cheapest, retained: true},
+			mqtt_message{topic: base + "/last_checked", payload: state.LastChecked.Format(time.RFC3339), retained: true},
+			mqtt_message{topic: base + "/state", payload: string(b), retained: true},
+		)
+	}
+
+	for _, event := range Build_events(alert) {
+		if event.Type == Event_listing_scraped {
+			continue
+		}
+		b, _ := json.Marshal(event)
+		messages = append(messages, mqtt_message{topic: base + "/events", payload: string(b)})
+	}
+	return messages
+}
+
+func (m *Mqtt) Send(ctx context.Context, alert Alert) error {
+	prefix := m.Prefix
+	if target := strings.Trim(alert.Targets[m.Name()], "/"); target != "" {
+		prefix = target
+	}
+
+	client, err := m.connect()
+	if err != nil {
+		return err
+	}
+
+	messages := m.mqtt_messages(alert, prefix)
+	var tokens []paho.Token
+	for _, msg := range messages {
+		// discovery configs are retained, once per process is enough
+		if strings.HasSuffix(msg.topic, "/config") {
+			m.mu.Lock()
+			if m.announced == nil {
+				m.announced = make(map[string]bool)
+			}
+			seen := m.announced[msg.topic]
+			m.announced[msg.topic] = true
+			m.mu.Unlock()
+			if seen {
+				continue
+			}
+		}
+		tokens = append(tokens, client.Publish(msg.topic, 1, msg.retained, msg.payload))
+	}
+
+	deadline := time.Now().Add(mqtt_timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	var failed []string
+	for _, token := range tokens {
+		if !token.WaitTimeout(time.Until(deadline)) {
+			failed = append(failed, "timed out")
+			continue
+		}
+		if err := token.Error(); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		// forget the announcements so the retry sends them again
+		m.mu.Lock()
+		m.announced = make(map[string]bool)
+		m.mu.Unlock()
+
+		return utils.New_error(utils.ErrNotifier, fmt.Sprintf("publishing %d of %d mqtt messages failed: %s", len(failed), len(tokens), failed[0]), nil)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	digest "github.com/anthonybliss1/go-apts/internal/digest"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+	rules "github.com/anthonybliss1/go-apts/internal/rules"
+	store "github.com/anthonybliss1/go-apts/internal/store"
+	unitstate "github.com/anthonybliss1/go-apts/internal/unitstate"
+)
+
+// Alert is everything a notifier needs to tell someone about a listing. it's built once per scrape
+// and handed to every channel, each one renders it its own way
+type Alert struct {
+	ListingURL  string
+	ListingName string
+	Units       []utils.Apartments
+	Photos      []string // building photos from the listing page, floor plans are on the units
+	ScrapedAt   time.Time
+	Diff        history.Diff // what changed since the last scrape of this listing
+	TargetRent  float64      // the watch's target rent, 0 if it doesn't have one
+
+	// muted / interested / toured marks from the alert buttons. muted units are already left out of Units
+	ListingID string
+	State     unitstate.Listing_state
+
+	// per-channel destination overrides from the watch (e.g. "slack" -> webhook URL),
+	// channels fall back to their global setting when theirs isn't here
+	Targets map[string]string
+	WatchID string // the watch this alert is for, empty for a one-off /chat?url= check
+
+	// notification templates from the watch keyed by channel (or "default"), see templates.go
+	Templates map[string]string
+
+	// when each channel sends, keyed by channel (or "default"). held alerts are queued for a digest
+	Delivery map[string]digest.Policy
+
+	// set on a digest: the queued alerts merged to one per listing. Units is empty and channels send Render_digest
+	Digest []Alert
+
+	// set when a watch rule fired: Units is only the unit it's about and channels send Render_trigger
+	Trigger *rules.Trigger
+}
+
+func (a Alert) Unit_state(apt utils.Apartments) unitstate.Unit_state {
+	return a.State.Unit(unitstate.Unit_id(history.Unit_key(apt)))
+}
+
+type Notifier interface {
+	// name used to pick the channel on a watch or in notifiers.default_channels (e.g. "telegram")
+	Name() string
+	Send(ctx context.Context, alert Alert) error
+}
+
+type Registry struct {
+	mu        sync.RWMutex
+	notifiers map[string]Notifier
+}
+
+func New_registry() *Registry {
+	return &Registry{notifiers: make(map[string]Notifier)}
+}
+
+// registering the same name twice replaces the first one
+func (r *Registry) Register(n Notifier) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.notifiers[n.Name()] = n
+}
+
+func (r *Registry) Get(name string) (Notifier, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n, ok := r.notifiers[name]
+	return n, ok
+}
+
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.notifiers))
+	for name := range r.notifiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// looks up every name up front so a typo in a watch fails before anything is sent
+func (r *Registry) Resolve(names []string) ([]Notifier, error) {
+	var notifiers []Notifier
+	for _, name := range names {
+		n, ok := r.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("notification channel %q is not configured (have %v)", name, r.Names())
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+// a channel that only takes alerts from high priority watch rules (sms, where every message costs)
+type rule_only interface {
+	Rule_only() bool
+}
+
+// Rule_only_channels is the names that can't be used on a watch or /chat, only on a high priority rule
+func (r *Registry) Rule_only_channels(names []string) []string {
+	var only []string
+	for _, name := range names {
+		if n, ok := r.Get(name); ok {
+			if ro, ok := n.(rule_only); ok && ro.Rule_only() {
+				only = append(only, name)
+			}
+		}
+	}
+	return only
+}
+
+// channels set up in main from the config, shared by /chat and the watches
+var Channels = New_registry()
+
+// last snapshot of every listing we've alerted on, main swaps in one backed by the store
+var Unit_history = history.New(store.Memory())
+
+// per-unit marks from the telegram buttons, main swaps in one backed by the store
+var Unit_states = unitstate.New(store.Memory())
+
+// alerts held back by a digest or quiet hours policy, main swaps in one backed by the store
+var Digests = New_digest_queue(store.Memory())
+
+// every send goes through here, main swaps in one backed by the store
+var Outgoing = New_outbox(store.Memory())
@@ -0,0 +1,392 @@
+package notify
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	config "github.com/anthonybliss1/go-apts/internal/config"
+	store "github.com/anthonybliss1/go-apts/internal/store"
+)
+
+const outbox_bucket = "outbox"
+
+const (
+	Outbox_pending = "pending"
+	Outbox_sent    = "sent"
+	Outbox_failed  = "failed" // out of attempts (or dropped), waits for a replay
+)
+
+// ErrQueued is wrapped into a send that failed but will be retried by the outbox worker
+var ErrQueued = errors.New("queued for retry")
+
+// ErrDropped is wrapped into a send error that another try wouldn't fix (e.g. the sms daily limit).
+// the entry fails straight away instead of burning its attempts
+var ErrDropped = errors.New("dropped without retrying")
+
+// ErrAlreadySent is returned when replaying an entry that went out fine
+var ErrAlreadySent = errors.New("already sent")
+
+// ErrPreviouslyFailed is returned by Enqueue when the key is still deduped but its entry ran out of attempts,
+// so the caller hears about it instead of the repeat looking sent. replaying the entry tries it again
+var ErrPreviouslyFailed = errors.New("the same alert already failed, replay it from the outbox")
+
+// how long an explicit Idempotency-Key is remembered
+const explicit_key_window = 24 * time.Hour
+
+// how long failed entries wait for a replay before the worker drops them
+const failed_kept = 7 * 24 * time.Hour
+
+// Outbox_entry is one alert for one channel, kept until it's sent (and a while after, for dedupe)
+type Outbox_entry struct {
+	ID          string
+	Key         string // idempotency key, the same key for the same channel is only sent once
+	Channel     string
+	Alert       Alert
+	Status      string
+	Attempts    int
+	LastError   string
+	CreatedAt   time.Time
+	NextAttempt time.Time
+	SentAt      time.Time
+	FailedAt    time.Time // when it ran out of attempts
+	DedupeUntil time.Time // repeats of Key are dropped until then
+
+	// destinations the alert already got to, for channels that fan out (telegram chats, sms numbers,
+	// webhook endpoints). a retry after a partial failure only goes to the rest
+	Delivered []string `json:",omitempty"`
+}
+
+// Outbox persists every outgoing notification so an unreachable channel doesn't lose the alert
+type Outbox struct {
+	MaxAttempts  int
+	DedupeWindow time.Duration // how long identical alerts without an Idempotency-Key are deduped
+	RetryBase    time.Duration // first retry delay, doubled every attempt up to an hour
+
+	mu        sync.Mutex
+	store     *store.Store
+	in_flight map[string]bool
+}
+
+func New_outbox(s *store.Store) *Outbox {
+	return &Outbox{
+		MaxAttempts:  8,
+		DedupeWindow: 10 * time.Minute,
+		RetryBase:    30 * time.Second,
+		store:        s,
+		in_flight:    make(map[string]bool),
+	}
+}
+
+// New_outbox_from_config is New_outbox with notifiers.outbox's attempts and dedupe window
+func New_outbox_from_config(c config.Outbox, s *store.Store) *Outbox {
+	o := New_outbox(s)
+	o.MaxAttempts = c.MaxAttempts
+	o.DedupeWindow = c.DedupeWindow.Std()
+	return o
+}
+
+type idempotency_key_ctx struct{}
+
+// With_idempotency_key makes sends under ctx use key (e.g. from an Idempotency-Key header) instead of
+// deduping on the alert's content
+func With_idempotency_key(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotency_key_ctx{}, key)
+}
+
+func idempotency_key(ctx context.Context) string {
+	key, _ := ctx.Value(idempotency_key_ctx{}).(string)
+	return key
+}
+
+type delivered_ctx struct{}
+
+// delivery_progress is what a send under Attempt got through to, keyed however the channel likes
+type delivery_progress struct {
+	mu   sync.Mutex
+	done map[string]bool
+}
+
+func with_delivered(ctx context.Context, delivered []string) (context.Context, *delivery_progress) {
+	p := &delivery_progress{done: make(map[string]bool)}
+	for _, dest := range delivered {
+		p.done[dest] = true
+	}
+	return context.WithValue(ctx, delivered_ctx{}, p), p
+}
+
+// already_delivered is true when an earlier attempt of the same outbox entry got dest through
+func already_delivered(ctx context.Context, dest string) bool {
+	p, ok := ctx.Value(delivered_ctx{}).(*delivery_progress)
+	if !ok {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done[dest]
+}
+
+// mark_delivered records dest as done, sends outside the outbox have nothing to record it on
+func mark_delivered(ctx context.Context, dest string) {
+	p, ok := ctx.Value(delivered_ctx{}).(*delivery_progress)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done[dest] = true
+}
+
+func (p *delivery_progress) list() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delivered := make([]string, 0, len(p.done))
+	for dest := range p.done {
+		delivered = append(delivered, dest)
+	}
+	sort.Strings(delivered)
+	return delivered
+}
+
+// content_key is the same for the same units going to the same place, so a cron retry that
+// scrapes the same thing again doesn't send it twice
+func content_key(channel string, alert Alert) string {
+	b, _ := json.Marshal(struct {
+		Target  string
+		WatchID string
+		URL     string
+		Units   any
+		Trigger any
+	}{alert.Targets[channel], alert.WatchID, alert.ListingURL, alert.Units, alert.Trigger})
+	sum := sha256.Sum256(b)
+	return "content:" + hex.EncodeToString(sum[:12])
+}
+
+func entry_id(channel string, key string) string {
+	sum := sha256.Sum256([]byte(channel + "|" + key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Enqueue stores alert for channel. duplicate is true (and nothing is stored) when the same key is still
+// being retried, or was sent or failed within its dedupe window. a failed one also comes back with
+// ErrPreviouslyFailed. once the window is over the key starts a new entry
+func (o *Outbox) Enqueue(channel string, alert Alert, key string) (entry Outbox_entry, duplicate bool, err error) {
+	now := time.Now()
+	window := explicit_key_window
+	if key == "" {
+		key = content_key(channel, alert)
+		window = o.DedupeWindow
+	}
+	id := entry_id(channel, key)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var existing Outbox_entry
+	found, err := o.store.Get(outbox_bucket, id, &existing)
+	if err != nil {
+		return Outbox_entry{}, false, err
+	}
+	if found {
+		switch {
+		case existing.Status == Outbox_pending:
+			return existing, true, nil
+		case now.Before(existing.DedupeUntil) && existing.Status == Outbox_failed:
+			return existing, true, fmt.Errorf("outbox entry %s: %w", existing.ID, ErrPreviouslyFailed)
+		case now.Before(existing.DedupeUntil):
+			return existing, true, nil
+		}
+	}
+
+	entry = Outbox_entry{
+		ID:          id,
+		Key:         key,
+		Channel:     channel,
+		Alert:       alert,
+		Status:      Outbox_pending,
+		CreatedAt:   now,
+		NextAttempt: now.Add(o.RetryBase), // the caller tries it straight away, the worker only if that never happens
+		DedupeUntil: now.Add(window),
+	}
+	return entry, false, o.store.Put(outbox_bucket, id, entry)
+}
+
+// Attempt sends entry once and records how it went. a failure comes back wrapping ErrQueued while
+// there are attempts left, unless the channel dropped it
+func (o *Outbox) Attempt(ctx context.Context, entry Outbox_entry) error {
+	o.mu.Lock()
+	if o.in_flight[entry.ID] {
+		o.mu.Unlock()
+		return nil
+	}
+	o.in_flight[entry.ID] = true
+
+	// the copy passed in can be stale, another attempt may have sent it since
+	found, err := o.store.Get(outbox_bucket, entry.ID, &entry)
+	o.mu.Unlock()
+	if err != nil || !found || entry.Status != Outbox_pending {
+		o.mu.Lock()
+		delete(o.in_flight, entry.ID)
+		o.mu.Unlock()
+		return err
+	}
+
+	defer func() {
+		o.mu.Lock()
+		delete(o.in_flight, entry.ID)
+		o.mu.Unlock()
+	}()
+
+	var send_err error
+	if n, ok := Channels.Get(entry.Channel); ok {
+		send_ctx, progress := with_delivered(ctx, entry.Delivered)
+		send_err = n.Send(send_ctx, entry.Alert)
+		entry.Delivered = progress.list()
+	} else {
+		send_err = fmt.Errorf("channel %q isn't configured", entry.Channel)
+	}
+
+	now := time.Now()
+	entry.Attempts++
+	switch {
+	case send_err == nil:
+		entry.Status = Outbox_sent
+		entry.SentAt = now
+		entry.LastError = ""
+	case entry.Attempts >= o.MaxAttempts, errors.Is(send_err, ErrDropped):
+		entry.Status = Outbox_failed
+		entry.FailedAt = now
+		entry.LastError = send_err.Error()
+	default:
+		entry.Status = Outbox_pending
+		entry.LastError = send_err.Error()
+		entry.NextAttempt = now.Add(o.backoff(entry.Attempts))
+	}
+
+	o.mu.Lock()
+	put_err := o.store.Put(outbox_bucket, entry.ID, entry)
+	o.mu.Unlock()
+	if put_err != nil {
+		log.Printf("outbox: saving %s: %v\n", entry.ID, put_err)
+	}
+
+	if send_err == nil {
+		return nil
+	}
+	if entry.Status == Outbox_pending {
+		return errors.Join(send_err, ErrQueued)
+	}
+	return send_err
+}
+
+func (o *Outbox) backoff(attempts int) time.Duration {
+	d := o.RetryBase
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	return min(d, time.Hour)
+}
+
+// Run retries due entries, drops sent ones past their dedupe window and failed ones nobody replayed
+// until ctx is done
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		o.work(ctx, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *Outbox) work(ctx context.Context, now time.Time) {
+	for _, entry := range o.List("") {
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch {
+		case entry.Status == Outbox_sent && now.After(entry.DedupeUntil),
+			entry.Status == Outbox_failed && now.After(entry.DedupeUntil) && now.After(entry.FailedAt.Add(failed_kept)):
+			o.mu.Lock()
+			if err := o.store.Delete(outbox_bucket, entry.ID); err != nil {
+				log.Printf("outbox: removing %s: %v\n", entry.ID, err)
+			}
+			o.mu.Unlock()
+		case entry.Status == Outbox_pending && !now.Before(entry.NextAttempt):
+			// ctx only stops the loop, a send that started goes through
+			if err := o.Attempt(context.WithoutCancel(ctx), entry); err != nil {
+				log.Printf("outbox: %s to %s (attempt %d): %v\n", entry.ID, entry.Channel, entry.Attempts+1, err)
+			}
+		}
+	}
+}
+
+// List is every entry with status (all of them when empty), newest first
+func (o *Outbox) List(status string) []Outbox_entry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var entries []Outbox_entry
+	for _, id := range o.store.Keys(outbox_bucket) {
+		var entry Outbox_entry
+		found, err := o.store.Get(outbox_bucket, id, &entry)
+		if err != nil || !found {
+			continue
+		}
+		if status == "" || entry.Status == status {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CreatedAt.After(entries[j].CreatedAt) })
+	return entries
+}
+
+// Replay gives a failed (or stuck pending) entry a fresh set of attempts and sends it now.
+// how the send went is on the returned entry, err is only for entries that can't be replayed
+func (o *Outbox) Replay(ctx context.Context, id string) (Outbox_entry, bool, error) {
+	o.mu.Lock()
+	var entry Outbox_entry
+	found, err := o.store.Get(outbox_bucket, id, &entry)
+	if err != nil || !found {
+		o.mu.Unlock()
+		return Outbox_entry{}, found, err
+	}
+	if entry.Status == Outbox_sent {
+		o.mu.Unlock()
+		return entry, true, fmt.Errorf("%s: %w", id, ErrAlreadySent)
+	}
+
+	entry.Status = Outbox_pending
+	entry.Attempts = 0
+	entry.FailedAt = time.Time{}
+	entry.NextAttempt = time.Now()
+	err = o.store.Put(outbox_bucket, id, entry)
+	o.mu.Unlock()
+	if err != nil {
+		return entry, true, err
+	}
+
+	if err := o.Attempt(ctx, entry); err != nil {
+		log.Printf("outbox: replaying %s: %v\n", id, err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, err = o.store.Get(outbox_bucket, id, &entry)
+	return entry, true, err
+}
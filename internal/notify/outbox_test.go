@@ -0,0 +1,216 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	store "github.com/anthonybliss1/go-apts/internal/store"
+)
+
+// set_status rewrites a stored entry as if the worker had got that far with it
+func set_status(t *testing.T, o *Outbox, id string, status string, dedupe_until time.Time) {
+	t.Helper()
+
+	var entry Outbox_entry
+	if _, err := o.store.Get(outbox_bucket, id, &entry); err != nil {
+		t.Fatal(err)
+	}
+	entry.Status = status
+	entry.DedupeUntil = dedupe_until
+	if status == Outbox_failed {
+		entry.FailedAt = time.Now()
+	}
+	if err := o.store.Put(outbox_bucket, id, entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnqueueDedupe(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		status        string
+		dedupe_until  time.Time
+		duplicate     bool
+		failed_before bool
+	}{
+		{"pending", Outbox_pending, now.Add(time.Hour), true, false},
+		{"pending past its window is still being retried", Outbox_pending, now.Add(-time.Hour), true, false},
+		{"sent", Outbox_sent, now.Add(time.Hour), true, false},
+		{"sent past its window", Outbox_sent, now.Add(-time.Hour), false, false},
+		{"failed", Outbox_failed, now.Add(time.Hour), true, true},
+		{"failed past its window", Outbox_failed, now.Add(-time.Hour), false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := New_outbox(store.Memory())
+			alert := test_alert("https://www.apartments.com/example/")
+
+			first, duplicate, err := o.Enqueue("telegram", alert, "")
+			if err != nil || duplicate {
+				t.Fatalf("first enqueue: duplicate %v, err %v", duplicate, err)
+			}
+			set_status(t, o, first.ID, tt.status, tt.dedupe_until)
+
+			again, duplicate, err := o.Enqueue("telegram", alert, "")
+			if duplicate != tt.duplicate {
+				t.Errorf("duplicate = %v, want %v", duplicate, tt.duplicate)
+			}
+			if errors.Is(err, ErrPreviouslyFailed) != tt.failed_before {
+				t.Errorf("err = %v, want ErrPreviouslyFailed %v", err, tt.failed_before)
+			}
+			if !tt.failed_before && err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if again.ID != first.ID {
+				t.Errorf("id = %s, want %s", again.ID, first.ID)
+			}
+			if !duplicate && again.Status != Outbox_pending {
+				t.Errorf("a new entry should be pending, got %s", again.Status)
+			}
+		})
+	}
+}
+
+func TestEnqueueKeys(t *testing.T) {
+	o := New_outbox(store.Memory())
+
+	a := test_alert("https://www.apartments.com/a/")
+	b := test_alert("https://www.apartments.com/b/")
+
+	if _, duplicate, _ := o.Enqueue("telegram", a, ""); duplicate {
+		t.Fatal("first alert was a duplicate")
+	}
+	if _, duplicate, _ := o.Enqueue("telegram", b, ""); duplicate {
+		t.Error("a different listing was deduped")
+	}
+	if _, duplicate, _ := o.Enqueue("slack", a, ""); duplicate {
+		t.Error("the same alert on another channel was deduped")
+	}
+
+	// an explicit key dedupes whatever the content
+	if _, duplicate, _ := o.Enqueue("telegram", a, "cron-1"); duplicate {
+		t.Error("first use of a key was deduped")
+	}
+	if _, duplicate, _ := o.Enqueue("telegram", b, "cron-1"); !duplicate {
+		t.Error("the same key with other content wasn't deduped")
+	}
+}
+
+// fan_out stands in for a channel with several destinations, failing the ones in down
+type fan_out struct {
+	name  string
+	dests []string
+	down  map[string]bool
+	sent  []string
+}
+
+func (f *fan_out) Name() string { return f.name }
+
+func (f *fan_out) Send(ctx context.Context, alert Alert) error {
+	var failed []string
+	for _, dest := range f.dests {
+		if already_delivered(ctx, dest) {
+			continue
+		}
+		if f.down[dest] {
+			failed = append(failed, dest)
+			continue
+		}
+		f.sent = append(f.sent, dest)
+		mark_delivered(ctx, dest)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed: %v", failed)
+	}
+	return nil
+}
+
+func TestAttemptRetriesOnlyFailedDestinations(t *testing.T) {
+	// Attempt looks channels up in the global registry, give it one with just the fake in it
+	saved := Channels
+	Channels = New_registry()
+	t.Cleanup(func() { Channels = saved })
+
+	channel := &fan_out{name: "test-fan-out", dests: []string{"a", "b", "c"}, down: map[string]bool{"b": true}}
+	Channels.Register(channel)
+
+	o := New_outbox(store.Memory())
+	entry, _, err := o.Enqueue(channel.name, test_alert("https://www.apartments.com/example/"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Attempt(context.Background(), entry); !errors.Is(err, ErrQueued) {
+		t.Fatalf("first attempt: err = %v, want ErrQueued", err)
+	}
+
+	channel.down = nil
+	if err := o.Attempt(context.Background(), entry); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+
+	want := []string{"a", "c", "b"}
+	if fmt.Sprint(channel.sent) != fmt.Sprint(want) {
+		t.Errorf("sent %v, want %v", channel.sent, want)
+	}
+
+	var stored Outbox_entry
+	if _, err := o.store.Get(outbox_bucket, entry.ID, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != Outbox_sent || stored.Attempts != 2 {
+		t.Errorf("status %s after %d attempts, want sent after 2", stored.Status, stored.Attempts)
+	}
+	if fmt.Sprint(stored.Delivered) != "[a b c]" {
+		t.Errorf("delivered = %v", stored.Delivered)
+	}
+}
+
+// dropping stands in for a channel that turns an alert away for good, like sms over its daily limit
+type dropping struct{ sends int }
+
+func (d *dropping) Name() string { return "test-dropping" }
+
+func (d *dropping) Send(ctx context.Context, alert Alert) error {
+	d.sends++
+	return fmt.Errorf("over the limit: %w", ErrDropped)
+}
+
+func TestAttemptDoesntRetryDropped(t *testing.T) {
+	saved := Channels
+	Channels = New_registry()
+	t.Cleanup(func() { Channels = saved })
+
+	channel := &dropping{}
+	Channels.Register(channel)
+
+	o := New_outbox(store.Memory())
+	entry, _, err := o.Enqueue(channel.Name(), test_alert("https://www.apartments.com/example/"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = o.Attempt(context.Background(), entry)
+	if !errors.Is(err, ErrDropped) || errors.Is(err, ErrQueued) {
+		t.Fatalf("err = %v, want ErrDropped and not queued", err)
+	}
+
+	var stored Outbox_entry
+	if _, err := o.store.Get(outbox_bucket, entry.ID, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != Outbox_failed || stored.Attempts != 1 || stored.LastError == "" {
+		t.Errorf("status %s after %d attempts (%q), want failed after 1 with the reason", stored.Status, stored.Attempts, stored.LastError)
+	}
+
+	// the worker only picks up pending entries, a second attempt doesn't send again
+	if err := o.Attempt(context.Background(), stored); err != nil || channel.sends != 1 {
+		t.Errorf("second attempt: err %v, %d sends, want nothing sent", err, channel.sends)
+	}
+}
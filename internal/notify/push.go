@@ -0,0 +1,189 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	config "github.com/anthonybliss1/go-apts/internal/config"
+)
+
+// self-hosted push servers: ntfy topics and Gotify apps
+
+func push_title(alert Alert, priority Priority) string {
+	name := alert.ListingName
+	if name == "" {
+		name = "Listing"
+	}
+
+	if len(alert.Digest) > 0 {
+		if priority == Priority_high {
+			return "🚨 go-apts digest: units under target"
+		}
+		return "🗞️ go-apts digest"
+	}
+	if alert.Trigger != nil {
+		return Trigger_title(alert)
+	}
+
+	switch priority {
+	case Priority_high:
+		return fmt.Sprintf("🚨 Under target at %s", name)
+	case Priority_low:
+		return fmt.Sprintf("No changes at %s", name)
+	}
+	return fmt.Sprintf("%s update", name)
+}
+
+// the channel's template if it has one, otherwise the compact one line per unit format
+func push_message(alert Alert, channel string) string {
+	if text, ok := render_custom(alert, channel); ok {
+		return text
+	}
+	return Render_compact(alert)
+}
+
+func push_post(ctx context.Context, client *http.Client, service string, endpoint string, headers map[string]string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal %s payload: %w", service, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building %s request: %w", service, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return utils.New_error(utils.ErrNotifier, "send "+service+" request", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &utils.Apts_error{Kind: utils.ErrNotifier, Detail: fmt.Sprintf("received status code %d from %s: %s", resp.StatusCode, service, strings.TrimSpace(string(reason))), Status: resp.StatusCode}
+	}
+	return nil
+}
+
+type Ntfy struct {
+	Server string // https://ntfy.sh or your own
+	Topic  string // global topic, a watch can pick another with Targets["ntfy"]
+	Token  string // access token for protected topics, optional
+	Client *http.Client
+}
+
+func New_ntfy(c config.Ntfy) (*Ntfy, error) {
+	if c.Topic == "" && !c.Enabled {
+		return nil, fmt.Errorf("ntfy topic not set")
+	}
+
+	server := c.Server
+	if server == "" {
+		server = "https://ntfy.sh"
+	}
+
+	return &Ntfy{
+		Server: strings.TrimRight(server, "/"),
+		Topic:  c.Topic,
+		Token:  c.Token,
+		Client: &http.Client{Timeout: 15 * time.Second},
+	}, nil
+}
+
+func (n *Ntfy) Name() string { return "ntfy" }
+
+// ntfy priorities go 1 (min) to 5 (max)
+var ntfy_priorities = map[Priority]int{Priority_low: 2, Priority_default: 3, Priority_high: 5}
+
+// tags are emoji shortcodes shown next to the title
+var ntfy_tags = map[Priority][]string{
+	Priority_low:     {"zzz"},
+	Priority_default: {"house"},
+	Priority_high:    {"rotating_light", "house"},
+}
+
+func (n *Ntfy) Send(ctx context.Context, alert Alert) error {
+	topic := n.Topic
+	if target := alert.Targets[n.Name()]; target != "" {
+		topic = target
+	}
+	if topic == "" {
+		return utils.New_error(utils.ErrNotifier, "no ntfy topic configured for this watch", nil)
+	}
+
+	priority := Alert_priority(alert)
+
+	// JSON publishing avoids having to squeeze emoji titles into HTTP headers
+	payload := map[string]any{
+		"topic":    topic,
+		"title":    push_title(alert, priority),
+		"message":  truncate(push_message(alert, n.Name()), 4000),
+		"priority": ntfy_priorities[priority],
+		"tags":     ntfy_tags[priority],
+		"click":    alert.ListingURL,
+	}
+
+	headers := map[string]string{}
+	if n.Token != "" {
+		headers["Authorization"] = "Bearer " + n.Token
+	}
+	return push_post(ctx, n.Client, "ntfy", n.Server+"/", headers, payload)
+}
+
+type Gotify struct {
+	Server string
+	Token  string // application token, a watch can send as another app with Targets["gotify"]
+	Client *http.Client
+}
+
+func New_gotify(c config.Gotify) (*Gotify, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("gotify url not set")
+	}
+
+	return &Gotify{
+		Server: strings.TrimRight(c.URL, "/"),
+		Token:  c.Token,
+		Client: &http.Client{Timeout: 15 * time.Second},
+	}, nil
+}
+
+func (g *Gotify) Name() string { return "gotify" }
+
+// gotify priorities are 0-10, the android app only makes noise from 4 and pops up from 8
+var gotify_priorities = map[Priority]int{Priority_low: 2, Priority_default: 5, Priority_high: 8}
+
+func (g *Gotify) Send(ctx context.Context, alert Alert) error {
+	token := g.Token
+	if target := alert.Targets[g.Name()]; target != "" {
+		token = target
+	}
+	if token == "" {
+		return utils.New_error(utils.ErrNotifier, "no gotify app token configured for this watch", nil)
+	}
+
+	priority := Alert_priority(alert)
+	payload := map[string]any{
+		"title":    push_title(alert, priority),
+		"message":  push_message(alert, g.Name()),
+		"priority": gotify_priorities[priority],
+		"extras": map[string]any{
+			"client::notification": map[string]any{"click": map[string]string{"url": alert.ListingURL}},
+		},
+	}
+
+	// token in a header rather than ?token= so it doesn't end up in proxy logs
+	return push_post(ctx, g.Client, "gotify", g.Server+"/message", map[string]string{"X-Gotify-Key": token}, payload)
+}
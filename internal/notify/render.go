@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+)
+
+// plain text version of an alert (Default_template), used by channels without their own formatting
+func Render_text(alert Alert) string {
+	text, err := execute(default_template, alert)
+	if err != nil {
+		// the built in template only fails on a bug, don't lose the alert over it
+		log.Printf("rendering default template: %v\n", err)
+		return Render_compact(alert)
+	}
+	return text
+}
+
+type Priority int
+
+const (
+	Priority_low Priority = iota + 1
+	Priority_default
+	Priority_high
+)
+
+// high when a new unit is at or under the watch's target rent, low when nothing changed since the last scrape.
+// rule alerts have their rule's priority
+func Alert_priority(alert Alert) Priority {
+	// a digest is as urgent as the most urgent listing in it
+	if len(alert.Digest) > 0 {
+		highest := Priority_low
+		for _, part := range alert.Digest {
+			highest = max(highest, Alert_priority(part))
+		}
+		return highest
+	}
+
+	if alert.Trigger != nil {
+		for p, name := range priority_names {
+			if name == alert.Trigger.Rule.Priority_name() {
+				return p
+			}
+		}
+	}
+
+	changed := len(alert.Diff.Removed) > 0
+	for _, apt := range alert.Units {
+		change := alert.Diff.Change_for(apt)
+		if change.Kind == history.Added && alert.TargetRent > 0 && apt.Rent > 0 && apt.Rent <= alert.TargetRent {
+			return Priority_high
+		}
+		if change.Kind != history.Unchanged {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return Priority_low
+	}
+	return Priority_default
+}
+
+// short alert for push / SMS: a summary line then one line per unit
+func Render_compact(alert Alert) string {
+	name := alert.ListingName
+	if name == "" {
+		name = "Listing"
+	}
+	if len(alert.Units) == 0 {
+		return fmt.Sprintf("No available units right now at %s", name)
+	}
+
+	var lines []string
+	for _, apt := range alert.Units {
+		lines = append(lines, change_marker(alert.Diff.Change_for(apt))+" "+Unit_line(apt))
+	}
+
+	return compact_summary(alert) + "\n" + strings.Join(lines, "\n")
+}
+
+func change_marker(change history.Change) string {
+	switch change.Kind {
+	case history.Added:
+		return "🆕"
+	case history.PriceDrop:
+		return "📉"
+	case history.PriceUp:
+		return "📈"
+	case history.Removed:
+		return "❌"
+	}
+	return "•"
+}
+
+// "12 available, 2 new, 1 price drops, 1 gone"
+func compact_summary(alert Alert) string {
+	var added, drops int
+	for _, apt := range alert.Units {
+		switch alert.Diff.Change_for(apt).Kind {
+		case history.Added:
+			added++
+		case history.PriceDrop:
+			drops++
+		}
+	}
+
+	summary := fmt.Sprintf("%d available", len(alert.Units))
+	if added > 0 {
+		summary += fmt.Sprintf(", %d new", added)
+	}
+	if drops > 0 {
+		summary += fmt.Sprintf(", %d price drops", drops)
+	}
+	if removed := len(alert.Diff.Removed); removed > 0 {
+		summary += fmt.Sprintf(", %d gone", removed)
+	}
+	return summary
+}
+
+// one unit on one line: "#204 1bd/1ba $1650 710sqft Now"
+func Unit_line(apt utils.Apartments) string {
+	unit := apt.UnitNumber
+	if unit == "" {
+		unit = apt.Name
+	}
+	return fmt.Sprintf("#%s %dbd/%.3gba $%.0f %.0fsqft %s", unit, apt.Beds, apt.Baths, apt.Rent, apt.SquareFeet, apt.AvailableDateText)
+}
@@ -0,0 +1,90 @@
+package notify
+
+import (
+	"fmt"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	rules "github.com/anthonybliss1/go-apts/internal/rules"
+)
+
+// Rule_alerts turns the rules that fired on a scrape into alerts of their own, each with just its unit
+func Rule_alerts(alert Alert, triggers []rules.Trigger) []Alert {
+	var alerts []Alert
+	for _, t := range triggers {
+		rule_alert := alert
+		rule_alert.Trigger = &t
+		rule_alert.Photos = nil
+		rule_alert.Units = nil
+		if t.Unit != (utils.Apartments{}) {
+			rule_alert.Units = []utils.Apartments{t.Unit}
+		}
+		alerts = append(alerts, rule_alert)
+	}
+	return alerts
+}
+
+func beds_label(beds int) string {
+	if beds == 0 {
+		return "studio"
+	}
+	return fmt.Sprintf("%d bed", beds)
+}
+
+// trigger_heading is what fired, without the emoji: "Price drop at Foo: Unit #204"
+func trigger_heading(alert Alert) (emoji string, heading string) {
+	name := alert.ListingName
+	if name == "" {
+		name = "Listing"
+	}
+
+	t := alert.Trigger
+	switch t.Rule.Type {
+	case rules.Price_drop:
+		return "📉", fmt.Sprintf("Price drop at %s: Unit %s", name, unit_label(t.Unit))
+	case rules.Under_target:
+		return "🎯", fmt.Sprintf("Under target at %s: Unit %s", name, unit_label(t.Unit))
+	case rules.Cheapest:
+		return "🏷️", fmt.Sprintf("Cheapest %s at %s changed", beds_label(t.Rule.Beds), name)
+	}
+	return "", name
+}
+
+// Trigger_title is the first line of a rule alert: "📉 Price drop at Foo: Unit #204"
+func Trigger_title(alert Alert) string {
+	emoji, heading := trigger_heading(alert)
+	if emoji == "" {
+		return heading
+	}
+	return emoji + " " + heading
+}
+
+// trigger_detail is the rent that made the rule fire: "$1,850, down $150 (7.5%) from its high of $2,000"
+func trigger_detail(t rules.Trigger) string {
+	switch t.Rule.Type {
+	case rules.Price_drop:
+		amount, percent := t.Drop()
+		return fmt.Sprintf("%s, down %s (%.1f%%) from its high of %s", currency(t.Unit.Rent), currency(amount), percent, currency(t.Peak))
+	case rules.Under_target:
+		return fmt.Sprintf("%s, %s under the %s target", currency(t.Unit.Rent), currency(t.Target-t.Unit.Rent), currency(t.Target))
+	case rules.Cheapest:
+		now := "none left"
+		if t.Unit != (utils.Apartments{}) {
+			now = fmt.Sprintf("Unit %s at %s", unit_label(t.Unit), currency(t.Unit.Rent))
+		}
+		before := "there wasn't one before"
+		if t.Previous != (utils.Apartments{}) {
+			before = fmt.Sprintf("was Unit %s at %s", unit_label(t.Previous), currency(t.Previous.Rent))
+		}
+		return fmt.Sprintf("now %s, %s", now, before)
+	}
+	return ""
+}
+
+// Render_trigger is the text of a rule alert, what fired and the unit it fired for
+func Render_trigger(alert Alert) string {
+	text := Trigger_title(alert) + "\n" + trigger_detail(*alert.Trigger)
+	if alert.Trigger.Unit != (utils.Apartments{}) {
+		text += "\n" + Unit_line(alert.Trigger.Unit)
+	}
+	return text
+}
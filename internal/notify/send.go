@@ -0,0 +1,239 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+	rules "github.com/anthonybliss1/go-apts/internal/rules"
+	unitstate "github.com/anthonybliss1/go-apts/internal/unitstate"
+	watch "github.com/anthonybliss1/go-apts/internal/watch"
+)
+
+// channels used when a /chat call doesn't name any and isn't for a watch. main sets it from notifiers.default_channels
+var Default_channel_names = []string{"telegram"}
+
+func Default_channels() []string {
+	return append([]string(nil), Default_channel_names...)
+}
+
+// where Operator_alert goes (notifiers.operator.telegram_chat_id) and the bot it's sent with, set by main
+var (
+	Operator_chat_id string
+	Operator_bot     *Telegram
+)
+
+// Build_alert scrapes the listing (through the cache) and turns it into an Alert. for a watch (watch_id set)
+// the diff is against that watch's last run and this run is recorded, unless the listing is snoozed so the
+// changes are still there when the snooze ends. a one-off check only compares against the listing's last
+// recorded scrape, it doesn't record anything
+func Build_alert(ctx context.Context, raw_url string, client *http.Client, force bool, watch_id string) (Alert, error) {
+	result, _, err := utils.Scrape_listing_cached(ctx, raw_url, client, force)
+	if err != nil {
+		return Alert{}, err
+	}
+	records, listing_name := result.Records, result.ListingName
+
+	listing_id := unitstate.Listing_id(raw_url)
+	state, err := Unit_states.Get(listing_id)
+	if err != nil {
+		log.Printf("reading unit state for %s: %v\n", raw_url, err)
+	}
+
+	var diff history.Diff
+	if watch_id != "" && !state.Snoozed(time.Now()) {
+		diff, err = Unit_history.Record(watch_id, raw_url, listing_name, records)
+	} else {
+		diff, err = Unit_history.Compare(raw_url, records)
+	}
+	if err != nil {
+		// the alert still goes out, it just can't say what changed
+		log.Printf("diffing history for %s: %v\n", raw_url, err)
+	}
+
+	// muted units never make it into an alert
+	var units []utils.Apartments
+	for _, apt := range records {
+		if !state.Unit(unitstate.Unit_id(history.Unit_key(apt))).Muted {
+			units = append(units, apt)
+		}
+	}
+
+	return Alert{
+		ListingURL:  raw_url,
+		ListingName: listing_name,
+		Units:       units,
+		ScrapedAt:   time.Now(),
+		Diff:        diff,
+		ListingID:   listing_id,
+		State:       state,
+		Photos:      result.Photos,
+	}, nil
+}
+
+// Deliver fans the alert out to every channel at once. one channel failing doesn't stop the others,
+// the errors come back joined. every send goes through the outbox, so a failed one is retried in the background
+// (its error wraps ErrQueued). channels whose delivery policy holds the alert queue it for a digest instead
+func Deliver(ctx context.Context, alert Alert, notifiers []Notifier) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(notifiers))
+	now := time.Now()
+
+	for i, n := range notifiers {
+		if policy := Delivery_policy(alert, n.Name()); policy.Hold(now) {
+			if err := Digests.Add(n.Name(), policy, alert); err != nil {
+				errs[i] = fmt.Errorf("%s: queueing for digest: %w", n.Name(), err)
+			}
+			continue
+		}
+
+		entry, duplicate, err := Outgoing.Enqueue(n.Name(), alert, idempotency_key(ctx))
+		if errors.Is(err, ErrPreviouslyFailed) {
+			errs[i] = fmt.Errorf("%s: %w", n.Name(), err)
+			continue
+		}
+		if err != nil {
+			errs[i] = fmt.Errorf("%s: saving to outbox: %w", n.Name(), err)
+			continue
+		}
+		// already sent (or still being retried) for an earlier call with the same key
+		if duplicate {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, n Notifier) {
+			defer wg.Done()
+			if err := Outgoing.Attempt(ctx, entry); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", n.Name(), err)
+			}
+		}(i, n)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		if errors.Is(err, utils.ErrNotifier) {
+			return err
+		}
+		return utils.New_error(utils.ErrNotifier, "", err)
+	}
+	return nil
+}
+
+// Send_watch scrapes a watch's listing and delivers it to the watch's channels and targets
+func Send_watch(ctx context.Context, wt watch.Watch, client *http.Client, force bool) error {
+	channels := wt.Channels
+	if len(channels) == 0 {
+		channels = Default_channels()
+	}
+
+	notifiers, err := Channels.Resolve(channels)
+	if err != nil {
+		return err
+	}
+
+	alert, err := Build_alert(ctx, wt.URL, client, force, wt.ID)
+	if err != nil {
+		return err
+	}
+	alert.Targets = wt.Targets
+	alert.WatchID = wt.ID
+	alert.Templates = wt.Templates
+	alert.Delivery = wt.Delivery
+	alert.TargetRent = wt.TargetRent
+
+	// snoozed from an alert button, skip quietly
+	if alert.State.Snoozed(time.Now()) {
+		return nil
+	}
+
+	errs := []error{Deliver(ctx, alert, notifiers)}
+
+	// every rule that fired is an alert of its own, on the rule's channels if it has any
+	triggers := rules.Evaluate(wt.Rules, alert.Units, alert.Diff, wt.TargetRent)
+	for _, rule_alert := range Rule_alerts(alert, triggers) {
+		rule_notifiers := notifiers
+		if channels := rule_alert.Trigger.Rule.Channels; len(channels) > 0 {
+			if rule_notifiers, err = Channels.Resolve(channels); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		errs = append(errs, Deliver(ctx, rule_alert, rule_notifiers))
+	}
+	return errors.Join(errs...)
+}
+
+// Operator_alert goes to the maintainer, not the tenants: Operator_chat_id on the same bot.
+// without one the alert is only logged
+func Operator_alert(subject string, body string) error {
+	if Operator_chat_id == "" {
+		return nil
+	}
+	if Operator_bot == nil {
+		return fmt.Errorf("operator alerts need notifiers.telegram.bot_token and chat_id")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return Operator_bot.Send_text(ctx, Operator_chat_id, fmt.Sprintf("🛠️ %s\n\n%s", subject, body))
+}
+
+// Preview_alert builds the alert a send would, from a live scrape or (stored) the last recorded one,
+// without recording history or sending anything. found is false when stored and nothing was recorded
+func Preview_alert(ctx context.Context, raw_url string, client *http.Client, stored bool) (alert Alert, found bool, err error) {
+	var records []utils.Apartments
+	var listing_name string
+	var photos []string
+	scraped_at := time.Now()
+
+	if stored {
+		listing_name, records, scraped_at, found, err = Unit_history.Latest(raw_url)
+		if err != nil || !found {
+			return Alert{}, found, err
+		}
+	} else {
+		result, _, err := utils.Scrape_listing_cached(ctx, raw_url, client, false)
+		if err != nil {
+			return Alert{}, false, err
+		}
+		records, listing_name, photos = result.Records, result.ListingName, result.Photos
+	}
+
+	// a stored scrape compares against itself, so it shows as unchanged
+	diff, err := Unit_history.Compare(raw_url, records)
+	if err != nil {
+		return Alert{}, false, err
+	}
+
+	listing_id := unitstate.Listing_id(raw_url)
+	state, err := Unit_states.Get(listing_id)
+	if err != nil {
+		return Alert{}, false, err
+	}
+
+	var units []utils.Apartments
+	for _, apt := range records {
+		if !state.Unit(unitstate.Unit_id(history.Unit_key(apt))).Muted {
+			units = append(units, apt)
+		}
+	}
+
+	return Alert{
+		ListingURL:  raw_url,
+		ListingName: listing_name,
+		Units:       units,
+		ScrapedAt:   scraped_at,
+		Diff:        diff,
+		ListingID:   listing_id,
+		State:       state,
+		Photos:      photos,
+	}, true, nil
+}
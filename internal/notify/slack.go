@@ -0,0 +1,207 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	config "github.com/anthonybliss1/go-apts/internal/config"
+)
+
+// slack allows 50 blocks per message, leave room for the header, divider and button
+const slack_units_per_message = 45
+
+// Slack posts alerts to an incoming webhook as Block Kit
+type Slack struct {
+	WebhookURL string // global webhook, a watch can override it with Targets["slack"]
+	Client     *http.Client
+}
+
+func New_slack(c config.Slack) (*Slack, error) {
+	if c.WebhookURL == "" && !c.Enabled {
+		return nil, fmt.Errorf("slack webhook url not set")
+	}
+
+	return &Slack{WebhookURL: c.WebhookURL, Client: &http.Client{Timeout: 15 * time.Second}}, nil
+}
+
+func (s *Slack) Name() string { return "slack" }
+
+type slack_text struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slack_element struct {
+	Type string     `json:"type"`
+	Text slack_text `json:"text"`
+	URL  string     `json:"url,omitempty"`
+}
+
+type slack_block struct {
+	Type     string          `json:"type"`
+	Text     *slack_text     `json:"text,omitempty"`
+	Fields   []slack_text    `json:"fields,omitempty"`
+	Elements []slack_element `json:"elements,omitempty"`
+}
+
+type slack_message struct {
+	Text   string        `json:"text"` // fallback for notifications / clients without blocks
+	Blocks []slack_block `json:"blocks"`
+}
+
+func (s *Slack) Send(ctx context.Context, alert Alert) error {
+	webhook_url := s.WebhookURL
+	if target := alert.Targets[s.Name()]; target != "" {
+		webhook_url = target
+	}
+	if webhook_url == "" {
+		return utils.New_error(utils.ErrNotifier, "no slack webhook configured for this watch", nil)
+	}
+
+	messages := slack_messages(alert)
+	if text, ok := render_custom(alert, s.Name()); ok {
+		messages = []slack_message{slack_text_message(alert, text)}
+	}
+
+	for i, msg := range messages {
+		// a long alert is several posts, an outbox retry picks up from the one that failed
+		msg_key := fmt.Sprintf("%s#%d", webhook_url, i)
+		if already_delivered(ctx, msg_key) {
+			continue
+		}
+		if err := s.post(ctx, webhook_url, msg); err != nil {
+			return err
+		}
+		mark_delivered(ctx, msg_key)
+	}
+	return nil
+}
+
+// slack_messages renders the alert as Block Kit, split so no message goes over slack's block limit
+func slack_messages(alert Alert) []slack_message {
+	name := alert.ListingName
+	if name == "" {
+		name = "Listing"
+	}
+
+	if len(alert.Units) == 0 {
+		return []slack_message{{
+			Text: fmt.Sprintf("No available units right now at %s", name),
+			Blocks: []slack_block{
+				{Type: "section", Text: &slack_text{Type: "mrkdwn", Text: fmt.Sprintf("No available units right now at *%s*", slack_escape(name))}},
+				slack_button(alert.ListingURL),
+			},
+		}}
+	}
+
+	var messages []slack_message
+	for start := 0; start < len(alert.Units); start += slack_units_per_message {
+		end := min(start+slack_units_per_message, len(alert.Units))
+
+		header := fmt.Sprintf("🚨 %s Alert", name)
+		if start > 0 {
+			header += " (cont.)"
+		}
+
+		blocks := []slack_block{{Type: "header", Text: &slack_text{Type: "plain_text", Text: truncate(header, 150)}}}
+		for _, apt := range alert.Units[start:end] {
+			blocks = append(blocks, slack_unit_section(apt))
+		}
+		blocks = append(blocks, slack_block{Type: "divider"}, slack_button(alert.ListingURL))
+
+		messages = append(messages, slack_message{
+			Text:   fmt.Sprintf("%s: %d available units", name, len(alert.Units)),
+			Blocks: blocks,
+		})
+	}
+	return messages
+}
+
+// a rendered template as one mrkdwn section (slack's limit is 3000 characters) and the listing button
+func slack_text_message(alert Alert, text string) slack_message {
+	text_blocks := []slack_block{{Type: "section", Text: &slack_text{Type: "mrkdwn", Text: truncate(slack_escape(text), 3000)}}}
+	// a digest covers several listings, their links are in the text
+	if alert.ListingURL != "" {
+		text_blocks = append(text_blocks, slack_button(alert.ListingURL))
+	}
+
+	return slack_message{
+		Text:   truncate(text, 3000),
+		Blocks: text_blocks,
+	}
+}
+
+func slack_unit_section(apt utils.Apartments) slack_block {
+	unit := apt.UnitNumber
+	if unit == "" {
+		unit = apt.Name
+	}
+
+	return slack_block{
+		Type: "section",
+		Text: &slack_text{Type: "mrkdwn", Text: fmt.Sprintf("*🏠 Unit %s*", slack_escape(unit))},
+		Fields: []slack_text{
+			{Type: "mrkdwn", Text: fmt.Sprintf("*Rent*\n$%.2f", apt.Rent)},
+			{Type: "mrkdwn", Text: fmt.Sprintf("*Beds / Baths*\n%d bd | %.1f ba", apt.Beds, apt.Baths)},
+			{Type: "mrkdwn", Text: fmt.Sprintf("*Size*\n%.0f sqft", apt.SquareFeet)},
+			{Type: "mrkdwn", Text: fmt.Sprintf("*Available*\n%s", slack_escape(apt.AvailableDateText))},
+		},
+	}
+}
+
+func slack_button(listing_url string) slack_block {
+	return slack_block{
+		Type: "actions",
+		Elements: []slack_element{{
+			Type: "button",
+			Text: slack_text{Type: "plain_text", Text: "View listing"},
+			URL:  listing_url,
+		}},
+	}
+}
+
+// slack mrkdwn only needs &, < and > escaped
+func slack_escape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-1]) + "…"
+}
+
+func (s *Slack) post(ctx context.Context, webhook_url string, msg slack_message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal slack payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", webhook_url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building slack request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return utils.New_error(utils.ErrNotifier, "send slack request", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// slack explains itself in the body (invalid_blocks, no_service, ...)
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &utils.Apts_error{Kind: utils.ErrNotifier, Detail: fmt.Sprintf("received status code %d from slack: %s", resp.StatusCode, strings.TrimSpace(string(reason))), Status: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+)
+
+func TestSlackRetryOnlyUnsentMessages(t *testing.T) {
+	var mu sync.Mutex
+	var first_units []string
+	posts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		posts++
+		// the second message fails once
+		if posts == 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var msg slack_message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || len(msg.Blocks) < 2 || msg.Blocks[1].Text == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		first_units = append(first_units, msg.Blocks[1].Text.Text)
+	}))
+	defer server.Close()
+
+	alert := test_alert("https://www.apartments.com/example/")
+	alert.ListingName = "The Example"
+	for i := range slack_units_per_message*2 + 1 {
+		alert.Units = append(alert.Units, utils.Apartments{Name: "A1", UnitNumber: fmt.Sprint(100 + i), Rent: 1500})
+	}
+	messages := slack_messages(alert)
+	if len(messages) != 3 {
+		t.Fatalf("alert splits into %d messages, want 3", len(messages))
+	}
+
+	s := &Slack{WebhookURL: server.URL, Client: server.Client()}
+	ctx, progress := with_delivered(context.Background(), nil)
+	if err := s.Send(ctx, alert); err == nil {
+		t.Fatal("send with a failing post succeeded")
+	}
+
+	retry, _ := with_delivered(context.Background(), progress.list())
+	if err := s.Send(retry, alert); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if posts != 4 || len(first_units) != 3 {
+		t.Fatalf("%d posts, %d went through, want 4 and 3", posts, len(first_units))
+	}
+	// every message once and in order, the retry doesn't post the first one again
+	for i, msg := range messages {
+		if first_units[i] != msg.Blocks[1].Text.Text {
+			t.Errorf("post %d starts with %q, want %q", i, first_units[i], msg.Blocks[1].Text.Text)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	config "github.com/anthonybliss1/go-apts/internal/config"
+	store "github.com/anthonybliss1/go-apts/internal/store"
+)
+
+const sms_usage_bucket = "sms_usage"
+
+// two SMS segments, a unit line is well under that
+const sms_max_length = 320
+
+// Sms texts high priority rule alerts through a Twilio-compatible Messages API. every message costs money,
+// so it only takes alerts from high priority rules and stops for the day at DailyLimit
+type Sms struct {
+	APIBase    string // https://api.twilio.com, or a local stand-in with api_base
+	AccountSID string
+	AuthToken  string
+	From       string   // sending number, or a messaging service sid (MG...)
+	To         []string // recipients, a watch can text others with Targets["sms"] (comma separated)
+	DailyLimit int      // messages per day across all recipients, 0 for no limit
+	Client     *http.Client
+	Usage      *store.Store
+
+	mu sync.Mutex // serialises the daily count
+}
+
+func New_sms(c config.Sms, usage *store.Store) (*Sms, error) {
+	if c.AccountSID == "" {
+		return nil, fmt.Errorf("twilio account sid not set")
+	}
+	if c.AuthToken == "" || c.From == "" {
+		return nil, fmt.Errorf("auth_token and from are required")
+	}
+
+	api_base := c.APIBase
+	if api_base == "" {
+		api_base = "https://api.twilio.com"
+	}
+
+	return &Sms{
+		APIBase:    strings.TrimRight(api_base, "/"),
+		AccountSID: c.AccountSID,
+		AuthToken:  c.AuthToken,
+		From:       c.From,
+		To:         c.To,
+		DailyLimit: c.DailyLimit,
+		Client:     &http.Client{Timeout: 15 * time.Second},
+		Usage:      usage,
+	}, nil
+}
+
+func (s *Sms) Name() string { return "sms" }
+
+// Rule_only keeps sms off watches and /chat, it can only be picked on high priority rules
+func (s *Sms) Rule_only() bool { return true }
+
+// sms_alerts is what's worth a text in alert: itself if it's a high priority rule alert, or those out of a digest
+func sms_alerts(alert Alert) []Alert {
+	if len(alert.Digest) > 0 {
+		var alerts []Alert
+		for _, part := range alert.Digest {
+			alerts = append(alerts, sms_alerts(part)...)
+		}
+		return alerts
+	}
+
+	if alert.Trigger != nil && Alert_priority(alert) == Priority_high {
+		return []Alert{alert}
+	}
+	return nil
+}
+
+// one line per unit, no emoji (they make every segment hold 70 characters instead of 160):
+// "Under target at Foo: Unit #204 $1,650, $150 under the $1,800 target"
+func sms_line(alert Alert) string {
+	_, heading := trigger_heading(alert)
+	return heading + " " + trigger_detail(*alert.Trigger)
+}
+
+func sms_text(alerts []Alert) string {
+	var lines []string
+	for _, alert := range alerts {
+		lines = append(lines, sms_line(alert))
+	}
+	// the link only when it's one listing, it's the longest part of the message
+	if len(alerts) == 1 && alerts[0].ListingURL != "" {
+		lines = append(lines, alerts[0].ListingURL)
+	}
+	return truncate(strings.Join(lines, "\n"), sms_max_length)
+}
+
+// take reserves n messages from today's allowance, false when that would go over DailyLimit.
+// a negative n gives messages that didn't go out back
+func (s *Sms) take(n int, now time.Time) (bool, error) {
+	if s.DailyLimit == 0 || s.Usage == nil {
+		return true, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day := now.Format("2006-01-02")
+	var sent int
+	if _, err := s.Usage.Get(sms_usage_bucket, day, &sent); err != nil {
+		return false, err
+	}
+	if n > 0 && sent+n > s.DailyLimit {
+		return false, nil
+	}
+	return true, s.Usage.Put(sms_usage_bucket, day, sent+n)
+}
+
+func (s *Sms) Send(ctx context.Context, alert Alert) error {
+	alerts := sms_alerts(alert)
+	if len(alerts) == 0 {
+		log.Printf("sms: skipping an alert that isn't from a high priority rule (%s)\n", alert.ListingURL)
+		return nil
+	}
+
+	to := s.To
+	if target := alert.Targets[s.Name()]; target != "" {
+		to = split_addresses(target)
+	}
+	if len(to) == 0 {
+		return utils.New_error(utils.ErrNotifier, "no sms recipients configured for this watch", nil)
+	}
+
+	// numbers an earlier attempt of this outbox entry already texted aren't texted (or counted) again
+	var pending []string
+	for _, number := range to {
+		if !already_delivered(ctx, number) {
+			pending = append(pending, number)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	to = pending
+
+	// dropped rather than retried, the outbox would only keep hitting the same limit. it's kept as failed so it can be replayed
+	now := time.Now()
+	ok, err := s.take(len(to), now)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		detail := fmt.Sprintf("sms daily limit of %d messages reached, dropping %q", s.DailyLimit, sms_line(alerts[0]))
+		return utils.New_error(utils.ErrRateLimited, detail, ErrDropped)
+	}
+
+	text := sms_text(alerts)
+	var failed []string
+	for _, number := range to {
+		if err := s.post(ctx, number, text); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", number, err))
+			continue
+		}
+		mark_delivered(ctx, number)
+	}
+	if len(failed) > 0 {
+		if _, err := s.take(-len(failed), now); err != nil {
+			log.Printf("sms: updating the daily count: %v\n", err)
+		}
+		return utils.New_error(utils.ErrNotifier, strings.Join(failed, "; "), nil)
+	}
+	return nil
+}
+
+// twilio's error body, e.g. {"code": 21211, "message": "The 'To' number is not a valid phone number."}
+type sms_error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (s *Sms) post(ctx context.Context, to string, text string) error {
+	form := url.Values{"To": {to}, "Body": {text}}
+	if strings.HasPrefix(s.From, "MG") {
+		form.Set("MessagingServiceSid", s.From)
+	} else {
+		form.Set("From", s.From)
+	}
+
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", s.APIBase, url.PathEscape(s.AccountSID))
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("building sms request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.AccountSID, s.AuthToken)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		detail := strings.TrimSpace(string(body))
+		var serr sms_error
+		if json.Unmarshal(body, &serr) == nil && serr.Message != "" {
+			detail = fmt.Sprintf("%d %s", serr.Code, serr.Message)
+		}
+		return fmt.Errorf("received status code %d: %s", resp.StatusCode, detail)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	config "github.com/anthonybliss1/go-apts/internal/config"
+	rules "github.com/anthonybliss1/go-apts/internal/rules"
+	store "github.com/anthonybliss1/go-apts/internal/store"
+)
+
+// twilio_stand_in answers the Messages API like Twilio, rejecting the numbers in bad
+type twilio_stand_in struct {
+	mu   sync.Mutex
+	bad  map[string]bool
+	sent []string
+	auth bool
+}
+
+func (s *twilio_stand_in) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, pass, ok := r.BasicAuth()
+	s.auth = ok && user == "AC123" && pass == "token"
+	if r.URL.Path != "/2010-04-01/Accounts/AC123/Messages.json" || r.ParseForm() != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	to := r.PostForm.Get("To")
+	if s.bad[to] {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code": 21211, "message": "The 'To' number is not a valid phone number."}`))
+		return
+	}
+	s.sent = append(s.sent, to)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *twilio_stand_in) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sent)
+}
+
+func new_test_sms(t *testing.T, stand_in *twilio_stand_in, to []string, daily_limit int) *Sms {
+	t.Helper()
+
+	server := httptest.NewServer(stand_in)
+	t.Cleanup(server.Close)
+
+	s, err := New_sms(config.Sms{
+		AccountSID: "AC123",
+		AuthToken:  "token",
+		From:       "+15550000000",
+		APIBase:    server.URL,
+		To:         to,
+		DailyLimit: daily_limit,
+	}, store.Memory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func sms_used(t *testing.T, s *Sms) int {
+	t.Helper()
+
+	var sent int
+	if _, err := s.Usage.Get(sms_usage_bucket, time.Now().Format("2006-01-02"), &sent); err != nil {
+		t.Fatal(err)
+	}
+	return sent
+}
+
+func TestSmsDailyLimit(t *testing.T) {
+	stand_in := &twilio_stand_in{}
+	s := new_test_sms(t, stand_in, []string{"+15551110001", "+15551110002"}, 3)
+
+	if err := s.Send(context.Background(), rule_alert(rules.Priority_high)); err != nil {
+		t.Fatal(err)
+	}
+	if stand_in.count() != 2 || sms_used(t, s) != 2 {
+		t.Fatalf("sent %d, counted %d, want 2 and 2", stand_in.count(), sms_used(t, s))
+	}
+	if !stand_in.auth {
+		t.Error("the request wasn't authenticated with the account sid and auth token")
+	}
+
+	// two more would go over 3, the alert is dropped rather than half sent, and not worth retrying
+	err := s.Send(context.Background(), rule_alert(rules.Priority_high))
+	if !errors.Is(err, ErrDropped) || !errors.Is(err, utils.ErrRateLimited) {
+		t.Fatalf("over the limit: err = %v, want ErrDropped and ErrRateLimited", err)
+	}
+	if stand_in.count() != 2 || sms_used(t, s) != 2 {
+		t.Errorf("over the limit: sent %d, counted %d, want 2 and 2", stand_in.count(), sms_used(t, s))
+	}
+}
+
+func TestSmsOnlyHighPriority(t *testing.T) {
+	stand_in := &twilio_stand_in{}
+	s := new_test_sms(t, stand_in, []string{"+15551110001"}, 0)
+
+	for _, alert := range []Alert{test_alert("https://www.apartments.com/example/"), rule_alert(rules.Priority_default)} {
+		if err := s.Send(context.Background(), alert); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stand_in.count() != 0 {
+		t.Errorf("sent %d texts for alerts that aren't high priority rules", stand_in.count())
+	}
+}
+
+func TestSmsFailedNumbersDontCount(t *testing.T) {
+	stand_in := &twilio_stand_in{bad: map[string]bool{"+15551110002": true}}
+	s := new_test_sms(t, stand_in, []string{"+15551110001", "+15551110002"}, 10)
+
+	ctx, progress := with_delivered(context.Background(), nil)
+	if err := s.Send(ctx, rule_alert(rules.Priority_high)); err == nil {
+		t.Fatal("send with a rejected number succeeded")
+	}
+	if sms_used(t, s) != 1 {
+		t.Errorf("counted %d, the rejected text shouldn't count", sms_used(t, s))
+	}
+
+	// an outbox retry only texts the number that failed
+	stand_in.mu.Lock()
+	stand_in.bad = nil
+	stand_in.mu.Unlock()
+
+	retry, _ := with_delivered(context.Background(), progress.list())
+	if err := s.Send(retry, rule_alert(rules.Priority_high)); err != nil {
+		t.Fatal(err)
+	}
+	if stand_in.count() != 2 || sms_used(t, s) != 2 {
+		t.Errorf("after the retry: sent %v, counted %d, want each number once", stand_in.sent, sms_used(t, s))
+	}
+}
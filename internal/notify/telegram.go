@@ -0,0 +1,437 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	config "github.com/anthonybliss1/go-apts/internal/config"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+	subscribers "github.com/anthonybliss1/go-apts/internal/subscribers"
+	unitstate "github.com/anthonybliss1/go-apts/internal/unitstate"
+)
+
+// telegram rejects messages over 4096 characters (counted in UTF-16 code units)
+const telegram_max_message = 4096
+
+const telegram_separator = "\n━━━━━━━━━━━━━━━━━\n"
+
+type Telegram struct {
+	BotToken    string
+	ChatID      string // default chat, used when nobody else is subscribed to the watch
+	APIBase     string // https://api.telegram.org unless pointed at a stand-in with api_base
+	Client      *http.Client
+	Subscribers *subscribers.Subscribers // chats/topics registered with setup or /subscribe, nil for just ChatID
+	AlbumPhotos int                      // building photos after the floor plan in new unit albums, -1 for no albums
+}
+
+func New_telegram(c config.Telegram) (*Telegram, error) {
+	if c.BotToken == "" {
+		return nil, fmt.Errorf("telegram bot token not set")
+	}
+	if c.ChatID == "" {
+		return nil, fmt.Errorf("telegram chat id not set")
+	}
+
+	// floor plan albums for new units, albums: false turns them off
+	album_photos := c.AlbumPhotos
+	if !c.Albums {
+		album_photos = -1
+	}
+
+	return &Telegram{
+		BotToken:    c.BotToken,
+		ChatID:      c.ChatID,
+		APIBase:     strings.TrimRight(c.APIBase, "/"),
+		Client:      &http.Client{Timeout: 15 * time.Second},
+		AlbumPhotos: album_photos,
+	}, nil
+}
+
+func (t *Telegram) Name() string { return "telegram" }
+
+type Inline_button struct {
+	Text         string `json:"text"`
+	URL          string `json:"url,omitempty"`
+	CallbackData string `json:"callback_data,omitempty"`
+}
+
+type Inline_keyboard struct {
+	InlineKeyboard [][]Inline_button `json:"inline_keyboard"`
+}
+
+type telegram_message struct {
+	ChatID                string           `json:"chat_id"`
+	MessageThreadID       int              `json:"message_thread_id,omitempty"` // forum topic
+	Text                  string           `json:"text"`
+	ParseMode             string           `json:"parse_mode,omitempty"`
+	DisableWebPagePreview bool             `json:"disable_web_page_preview,omitempty"`
+	ReplyMarkup           *Inline_keyboard `json:"reply_markup,omitempty"`
+}
+
+// chats (and forum topics) an alert goes to: the watch's telegram target (comma separated chat_id[:thread_id])
+// plus every subscriber following the watch, or the default chat when that comes up empty
+func (t *Telegram) destinations(alert Alert) ([]subscribers.Subscriber, error) {
+	var dests []subscribers.Subscriber
+	seen := map[string]bool{}
+	add := func(sub subscribers.Subscriber) {
+		if !seen[sub.Key()] {
+			seen[sub.Key()] = true
+			dests = append(dests, sub)
+		}
+	}
+
+	for _, target := range split_addresses(alert.Targets[t.Name()]) {
+		chat_id, thread_id, err := subscribers.Parse_target(target)
+		if err != nil {
+			return nil, err
+		}
+		add(subscribers.Subscriber{ChatID: chat_id, ThreadID: thread_id})
+	}
+
+	if t.Subscribers != nil {
+		following, err := t.Subscribers.For_watch(alert.WatchID)
+		if err != nil {
+			return nil, err
+		}
+		for _, sub := range following {
+			add(sub)
+		}
+	}
+
+	if len(dests) == 0 {
+		add(subscribers.Subscriber{ChatID: t.ChatID})
+	}
+	return dests, nil
+}
+
+func (t *Telegram) Send(ctx context.Context, alert Alert) error {
+	if len(alert.Digest) > 0 {
+		return t.send_digest(ctx, alert)
+	}
+
+	dests, err := t.destinations(alert)
+	if err != nil {
+		return err
+	}
+
+	parts := telegram_messages(alert)
+	if text, ok := render_custom(alert, t.Name()); ok {
+		parts = telegram_text_parts(text)
+	}
+
+	var albums [][]input_media
+	if t.AlbumPhotos >= 0 {
+		albums = telegram_albums(alert, t.AlbumPhotos)
+	}
+
+	// one chat failing (bot kicked, topic closed) shouldn't stop the rest
+	var errs []error
+	for _, dest := range dests {
+		// albums are best effort, once they've been tried a retry of the text doesn't send them again
+		if album_key := "albums:" + dest.Key(); !already_delivered(ctx, album_key) {
+			t.send_albums(ctx, dest, albums)
+			mark_delivered(ctx, album_key)
+		}
+		if err := t.send_parts(ctx, dest, alert, parts); err != nil {
+			if len(dests) > 1 {
+				err = fmt.Errorf("chat %s: %w", dest.Key(), err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// send_digest gives every chat a digest of just the listings it would have been alerted on
+func (t *Telegram) send_digest(ctx context.Context, alert Alert) error {
+	var order []subscribers.Subscriber
+	listings := make(map[string][]Alert)
+
+	for _, part := range alert.Digest {
+		part.Targets = alert.Targets
+		dests, err := t.destinations(part)
+		if err != nil {
+			return err
+		}
+		for _, dest := range dests {
+			if _, seen := listings[dest.Key()]; !seen {
+				order = append(order, dest)
+			}
+			listings[dest.Key()] = append(listings[dest.Key()], part)
+		}
+	}
+
+	var errs []error
+	for _, dest := range order {
+		own := alert
+		own.Digest = listings[dest.Key()]
+		if err := t.send_parts(ctx, dest, own, telegram_text_parts(Render_digest(own))); err != nil {
+			if len(order) > 1 {
+				err = fmt.Errorf("chat %s: %w", dest.Key(), err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t *Telegram) send_parts(ctx context.Context, dest subscribers.Subscriber, alert Alert, parts []telegram_part) error {
+	for i, part := range parts {
+		// sent by an earlier attempt of this outbox entry
+		part_key := fmt.Sprintf("%s#%d", dest.Key(), i)
+		if already_delivered(ctx, part_key) {
+			continue
+		}
+
+		msg := telegram_message{ChatID: dest.ChatID, MessageThreadID: dest.ThreadID, Text: part.text, ParseMode: "HTML", DisableWebPagePreview: true}
+		if part.plain {
+			msg.ParseMode = ""
+		}
+		msg.ReplyMarkup = telegram_keyboard(alert, part.units, i == len(parts)-1)
+
+		if err := t.Call(ctx, "sendMessage", msg, nil); err != nil {
+			if len(parts) > 1 {
+				return fmt.Errorf("part %d of %d: %w", i+1, len(parts), err)
+			}
+			return err
+		}
+		mark_delivered(ctx, part_key)
+	}
+	return nil
+}
+
+// callback data the bot understands (see internal/bot), kept well under telegram's 64 bytes
+const (
+	Callback_mute       = "mute"
+	Callback_interested = "int"
+	Callback_toured     = "tour"
+	Callback_snooze     = "snooze"
+)
+
+// one row of buttons per unit, then snooze / open listing under the last part
+func telegram_keyboard(alert Alert, units []utils.Apartments, last bool) *Inline_keyboard {
+	var rows [][]Inline_button
+
+	if alert.ListingID != "" {
+		for _, apt := range units {
+			unit_id := unitstate.Unit_id(history.Unit_key(apt))
+			data := func(action string) string {
+				return strings.Join([]string{action, alert.ListingID, unit_id}, ":")
+			}
+
+			label := unit_label(apt)
+			rows = append(rows, []Inline_button{
+				{Text: "🔇 Mute " + label, CallbackData: data(Callback_mute)},
+				{Text: "⭐ Interested", CallbackData: data(Callback_interested)},
+				{Text: "✅ Toured", CallbackData: data(Callback_toured)},
+			})
+		}
+	}
+
+	if last {
+		var row []Inline_button
+		if alert.ListingID != "" {
+			row = append(row, Inline_button{Text: "😴 Snooze building 7d", CallbackData: Callback_snooze + ":" + alert.ListingID})
+		}
+		if alert.ListingURL != "" {
+			row = append(row, Inline_button{Text: "🔗 Open listing", URL: alert.ListingURL})
+		}
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+	return &Inline_keyboard{InlineKeyboard: rows}
+}
+
+func unit_label(apt utils.Apartments) string {
+	if apt.UnitNumber != "" {
+		return "#" + apt.UnitNumber
+	}
+	return apt.Name
+}
+
+func telegram_length(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+func telegram_unit_html(alert Alert, apt utils.Apartments) string {
+	block := fmt.Sprintf("🏠 <b>Unit %s</b>\n🛏️ %d Bed | 🛁 %.1f Bath\n💰 $%.2f | 📏 %.0f sqft\n🗓️ %s",
+		html.EscapeString(unit_label(apt)), apt.Beds, apt.Baths, apt.Rent, apt.SquareFeet, html.EscapeString(apt.AvailableDateText))
+
+	state := alert.Unit_state(apt)
+	change := alert.Diff.Change_for(apt)
+
+	// price moves on units someone marked interested are the ones worth shouting about
+	if state.Interested {
+		block = "⭐ " + block
+		switch change.Kind {
+		case history.PriceDrop:
+			block += fmt.Sprintf("\n<b>📉 PRICE DROP: $%.2f → $%.2f</b>", change.OldRent, apt.Rent)
+		case history.PriceUp:
+			block += fmt.Sprintf("\n<b>📈 Price up: $%.2f → $%.2f</b>", change.OldRent, apt.Rent)
+		}
+	}
+	if state.Toured {
+		block += "\n✅ <i>toured</i>"
+	}
+	return block
+}
+
+type telegram_part struct {
+	text  string
+	units []utils.Apartments // the units in this part, each gets a row of buttons
+	plain bool               // user template output, sent without parse_mode so stray < and & don't get it rejected
+}
+
+// telegram_text_parts splits a rendered template at line breaks to stay under the message limit
+func telegram_text_parts(text string) []telegram_part {
+	var parts []telegram_part
+	current := ""
+
+	for _, line := range strings.SplitAfter(text, "\n") {
+		// a single line over the limit gets cut, there's nowhere better to split it
+		for telegram_length(line) > telegram_max_message {
+			cut := []rune(line)[:telegram_max_message/2]
+			if current != "" {
+				parts = append(parts, telegram_part{text: current, plain: true})
+				current = ""
+			}
+			parts = append(parts, telegram_part{text: string(cut), plain: true})
+			line = string([]rune(line)[len(cut):])
+		}
+
+		if telegram_length(current+line) > telegram_max_message {
+			parts = append(parts, telegram_part{text: current, plain: true})
+			current = ""
+		}
+		current += line
+	}
+	if strings.TrimSpace(current) != "" || len(parts) == 0 {
+		parts = append(parts, telegram_part{text: current, plain: true})
+	}
+	return parts
+}
+
+// telegram caps inline keyboards at 100 buttons, 3 per unit plus the last row
+const telegram_units_per_message = 30
+
+// telegram_messages renders the alert as HTML, split at unit boundaries so no part goes over telegram's limits
+func telegram_messages(alert Alert) []telegram_part {
+	name := html.EscapeString(alert.ListingName)
+	if len(alert.Units) == 0 {
+		return []telegram_part{{text: fmt.Sprintf("No available units right now at <b>%s</b>", name)}}
+	}
+
+	header := fmt.Sprintf("🚨 <b>%s Alert</b> 🚨\n\n", name)
+	cont_header := fmt.Sprintf("🚨 <b>%s Alert</b> (cont.)\n\n", name)
+
+	var parts []telegram_part
+	current := telegram_part{text: header}
+
+	for _, apt := range alert.Units {
+		block := telegram_unit_html(alert, apt)
+
+		next := current.text + block
+		if len(current.units) > 0 {
+			next = current.text + telegram_separator + block
+		}
+
+		full := len(current.units) == telegram_units_per_message || telegram_length(next) > telegram_max_message
+		if len(current.units) > 0 && full {
+			parts = append(parts, current)
+			current = telegram_part{text: cont_header + block}
+		} else {
+			current.text = next
+		}
+		current.units = append(current.units, apt)
+	}
+	return append(parts, current)
+}
+
+// builds the bot api url for method (sendMessage, getUpdates, ...)
+func (t *Telegram) method_url(method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", t.APIBase, t.BotToken, method)
+}
+
+// every bot api answer looks like this, description says what went wrong when ok is false
+type telegram_response struct {
+	OK          bool            `json:"ok"`
+	Description string          `json:"description"`
+	ErrorCode   int             `json:"error_code"`
+	Result      json.RawMessage `json:"result"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// Call POSTs payload to a bot api method and decodes the result into result (if not nil)
+func (t *Telegram) Call(ctx context.Context, method string, payload any, result any) error {
+	// marshal the payload to []byte type
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal telegram payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", t.method_url(method), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building telegram request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		// the url has the bot token in it, don't let it leak into the error
+		return utils.New_error(utils.ErrNotifier, "send telegram "+method+" request", strip_token(err, t.BotToken))
+	}
+	defer resp.Body.Close()
+
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	var tr telegram_response
+	json.Unmarshal(reply, &tr)
+
+	if resp.StatusCode != http.StatusOK || !tr.OK {
+		detail := fmt.Sprintf("received status code %d from telegram", resp.StatusCode)
+		if tr.Description != "" {
+			detail += ": " + tr.Description
+		}
+		if tr.Parameters.RetryAfter > 0 {
+			detail += fmt.Sprintf(" (retry after %ds)", tr.Parameters.RetryAfter)
+		}
+		return &utils.Apts_error{Kind: utils.ErrNotifier, Detail: detail, Status: resp.StatusCode}
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(tr.Result, result); err != nil {
+			return fmt.Errorf("decoding telegram %s result: %w", method, err)
+		}
+	}
+	return nil
+}
+
+func strip_token(err error, token string) error {
+	if token == "" {
+		return err
+	}
+	return fmt.Errorf("%s", strings.ReplaceAll(err.Error(), token, "<token>"))
+}
+
+// plain text message, used for operator alerts
+func (t *Telegram) Send_text(ctx context.Context, chat_id string, text string) error {
+	return t.Call(ctx, "sendMessage", telegram_message{ChatID: chat_id, Text: text}, nil)
+}
@@ -0,0 +1,116 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+	subscribers "github.com/anthonybliss1/go-apts/internal/subscribers"
+)
+
+// albums per alert, past that new units are only in the text message (telegram rate limits media hard)
+const telegram_max_albums = 5
+
+// telegram's caption limit, and its cap on photos in one album
+const (
+	telegram_max_caption = 1024
+	telegram_max_media   = 10
+)
+
+type input_media struct {
+	Type      string `json:"type"`
+	Media     string `json:"media"` // telegram fetches the image from this url itself
+	Caption   string `json:"caption,omitempty"`
+	ParseMode string `json:"parse_mode,omitempty"`
+}
+
+type media_group struct {
+	ChatID          string        `json:"chat_id"`
+	MessageThreadID int           `json:"message_thread_id,omitempty"`
+	Media           []input_media `json:"media"`
+}
+
+type photo_message struct {
+	ChatID          string `json:"chat_id"`
+	MessageThreadID int    `json:"message_thread_id,omitempty"`
+	Photo           string `json:"photo"`
+	Caption         string `json:"caption,omitempty"`
+	ParseMode       string `json:"parse_mode,omitempty"`
+}
+
+// "🆕 Listing: Unit #204" then "1 bd / 1.0 ba · $1,650 · 710 sqft · Now"
+func telegram_caption(alert Alert, apt utils.Apartments) string {
+	caption := fmt.Sprintf("🆕 <b>%s: Unit %s</b>\n%d bd / %.1f ba · %s · %.0f sqft",
+		html.EscapeString(alert.ListingName), html.EscapeString(unit_label(apt)), apt.Beds, apt.Baths, currency(apt.Rent), apt.SquareFeet)
+	if apt.AvailableDateText != "" {
+		caption += " · " + html.EscapeString(apt.AvailableDateText)
+	}
+	if telegram_length(caption) > telegram_max_caption {
+		caption = truncate(caption, telegram_max_caption/2)
+	}
+	return caption
+}
+
+// telegram_albums is an album per new unit: its floor plan then up to photos building photos,
+// captioned with the unit summary
+func telegram_albums(alert Alert, photos int) [][]input_media {
+	if len(alert.Digest) > 0 || alert.Trigger != nil {
+		return nil
+	}
+	building := alert.Photos[:min(photos, len(alert.Photos))]
+
+	var albums [][]input_media
+	for _, apt := range alert.Units {
+		if len(albums) == telegram_max_albums {
+			break
+		}
+		if alert.Diff.Change_for(apt).Kind != history.Added {
+			continue
+		}
+
+		var urls []string
+		if apt.FloorPlanURL != "" {
+			urls = append(urls, apt.FloorPlanURL)
+		}
+		// building photos alone don't say anything about the unit
+		if len(urls) == 0 {
+			continue
+		}
+		urls = append(urls, building...)
+
+		var media []input_media
+		for _, u := range urls[:min(len(urls), telegram_max_media)] {
+			media = append(media, input_media{Type: "photo", Media: u})
+		}
+		media[0].Caption = telegram_caption(alert, apt)
+		media[0].ParseMode = "HTML"
+		albums = append(albums, media)
+	}
+	return albums
+}
+
+// send_albums posts each album (sendPhoto when there's only the floor plan). a failed album is only
+// logged, the unit is in the text message that follows either way
+func (t *Telegram) send_albums(ctx context.Context, dest subscribers.Subscriber, albums [][]input_media) {
+	for _, media := range albums {
+		var err error
+		if len(media) == 1 {
+			err = t.Call(ctx, "sendPhoto", photo_message{
+				ChatID:          dest.ChatID,
+				MessageThreadID: dest.ThreadID,
+				Photo:           media[0].Media,
+				Caption:         media[0].Caption,
+				ParseMode:       media[0].ParseMode,
+			}, nil)
+		} else {
+			err = t.Call(ctx, "sendMediaGroup", media_group{ChatID: dest.ChatID, MessageThreadID: dest.ThreadID, Media: media}, nil)
+		}
+
+		if err != nil {
+			log.Printf("telegram: album for %s, falling back to text: %v\n", dest.Key(), err)
+		}
+	}
+}
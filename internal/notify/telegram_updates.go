@@ -0,0 +1,79 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// the parts of the bot api update objects go-apts reads
+
+type Telegram_user struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type Telegram_chat struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"` // private, group, supergroup or channel
+	Title     string `json:"title"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+}
+
+type Telegram_incoming struct {
+	MessageID       int            `json:"message_id"`
+	MessageThreadID int            `json:"message_thread_id"`
+	From            *Telegram_user `json:"from"`
+	Chat            Telegram_chat  `json:"chat"`
+	Text            string         `json:"text"`
+}
+
+// a press on one of the inline buttons with callback_data
+type Callback_query struct {
+	ID      string             `json:"id"`
+	From    Telegram_user      `json:"from"`
+	Message *Telegram_incoming `json:"message"`
+	Data    string             `json:"data"`
+}
+
+// the bot being added to (or removed from) a chat, the only way to see a channel before anything is posted in it
+type Chat_member_updated struct {
+	Chat Telegram_chat `json:"chat"`
+	From Telegram_user `json:"from"`
+}
+
+type Update struct {
+	UpdateID      int                  `json:"update_id"`
+	Message       *Telegram_incoming   `json:"message"`
+	ChannelPost   *Telegram_incoming   `json:"channel_post"`
+	CallbackQuery *Callback_query      `json:"callback_query"`
+	MyChatMember  *Chat_member_updated `json:"my_chat_member"`
+}
+
+// Get_updates long polls for up to timeout. the http client timeout has to be longer than that
+func (t *Telegram) Get_updates(ctx context.Context, offset int, timeout time.Duration) ([]Update, error) {
+	payload := map[string]any{
+		"offset":          offset,
+		"timeout":         int(timeout.Seconds()),
+		"allowed_updates": []string{"message", "channel_post", "callback_query"},
+	}
+
+	poller := *t
+	poller.Client = &http.Client{Timeout: timeout + 15*time.Second}
+
+	var updates []Update
+	err := poller.Call(ctx, "getUpdates", payload, &updates)
+	return updates, err
+}
+
+// Reply sends an HTML message to a chat (and forum topic, if thread_id isn't 0)
+func (t *Telegram) Reply(ctx context.Context, chat_id string, thread_id int, text string) error {
+	msg := telegram_message{ChatID: chat_id, MessageThreadID: thread_id, Text: text, ParseMode: "HTML", DisableWebPagePreview: true}
+	return t.Call(ctx, "sendMessage", msg, nil)
+}
+
+// Answer_callback stops the button's loading spinner and shows text as a toast
+func (t *Telegram) Answer_callback(ctx context.Context, callback_id string, text string) error {
+	return t.Call(ctx, "answerCallbackQuery", map[string]string{"callback_query_id": callback_id, "text": text}, nil)
+}
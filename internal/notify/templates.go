@@ -0,0 +1,309 @@
+package notify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+	unitstate "github.com/anthonybliss1/go-apts/internal/unitstate"
+)
+
+// folder of <channel>.tmpl files (and default.tmpl for every channel) that replace the built in message text.
+// read on every alert so edits apply without a restart, main sets it from notifiers.template_dir
+var Template_dir = ""
+
+// the template for every channel without one of its own, in Template_dir or on a watch
+const Template_default = "default"
+
+// Default_template is the plain text alert, what Render_text produces
+const Default_template = `{{if not .Units}}No available units right now at {{.ListingName}}{{else}}
+🚨 {{.ListingName}} Alert 🚨
+
+{{range $i, $u := .Units}}{{if $i}}
+━━━━━━━━━━━━━━━━━
+{{end}}🏠 Unit {{$u.Label}}{{with arrow $u.Change}} {{.}}{{end}}
+🛏️ {{$u.Beds}} Bed | 🛁 {{printf "%.1f" $u.Baths}} Bath
+💰 {{currency $u.Rent}}{{with diff $u.Change}} ({{.}}){{end}} | 📏 {{printf "%.0f" $u.SquareFeet}} sqft
+🗓️ {{$u.AvailableDateText}}{{end}}
+{{end}}`
+
+var default_template = template.Must(Parse_template(Default_template))
+
+// Template_unit is one unit as templates see it, the scraped fields plus what changed and the button marks
+type Template_unit struct {
+	utils.Apartments
+	Label  string // "#204", or the floor plan name when there's no unit number
+	Change history.Change
+	State  unitstate.Unit_state
+}
+
+// Template_data is the dot of a notification template
+type Template_data struct {
+	ListingName string
+	ListingURL  string
+	ScrapedAt   time.Time
+	Units       []Template_unit
+	Removed     []history.Change
+	TargetRent  float64
+	Priority    string // low, default or high
+	WatchID     string
+}
+
+var priority_names = map[Priority]string{
+	Priority_low:     "low",
+	Priority_default: "default",
+	Priority_high:    "high",
+}
+
+func template_data(alert Alert) Template_data {
+	name := alert.ListingName
+	if name == "" {
+		name = "Listing"
+	}
+
+	data := Template_data{
+		ListingName: name,
+		ListingURL:  alert.ListingURL,
+		ScrapedAt:   alert.ScrapedAt,
+		Removed:     alert.Diff.Removed,
+		TargetRent:  alert.TargetRent,
+		Priority:    priority_names[Alert_priority(alert)],
+		WatchID:     alert.WatchID,
+	}
+	for _, apt := range alert.Units {
+		data.Units = append(data.Units, Template_unit{
+			Apartments: apt,
+			Label:      unit_label(apt),
+			Change:     alert.Diff.Change_for(apt),
+			State:      alert.Unit_state(apt),
+		})
+	}
+	return data
+}
+
+// Template_funcs are the helpers every notification template gets
+var Template_funcs = template.FuncMap{
+	"currency": currency,
+	"per_sqft": per_sqft,
+	"relative": relative,
+	"arrow":    arrow,
+	"diff":     price_diff,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"truncate": truncate,
+}
+
+// currency formats dollars with thousands separators, cents only when there are some: $1,650 / $1,650.50
+func currency(v float64) string {
+	sign := ""
+	if v < 0 {
+		sign, v = "-", -v
+	}
+
+	cents := int64(math.Round(v * 100))
+	dollars := fmt.Sprint(cents / 100)
+	for i := len(dollars) - 3; i > 0; i -= 3 {
+		dollars = dollars[:i] + "," + dollars[i:]
+	}
+
+	if cents%100 != 0 {
+		return fmt.Sprintf("%s$%s.%02d", sign, dollars, cents%100)
+	}
+	return sign + "$" + dollars
+}
+
+// per_sqft is rent per square foot, empty when the listing doesn't give a size
+func per_sqft(rent float64, square_feet float64) string {
+	if rent <= 0 || square_feet <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("$%.2f/sqft", rent/square_feet)
+}
+
+// date formats apartments.com uses for availability
+var available_layouts = []string{"Jan. 2", "Jan 2", "January 2", "1/2/2006", "2006-01-02"}
+
+// relative turns a time or an availability date ("Mar. 5") into "in 3 days" / "2 hours ago".
+// text it can't read as a date (like "Now") comes back unchanged
+func relative(v any) string {
+	now := time.Now()
+
+	var t time.Time
+	switch v := v.(type) {
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		t = v
+	case string:
+		parsed, ok := parse_available(v, now)
+		if !ok {
+			return v
+		}
+		t = parsed
+	default:
+		return fmt.Sprint(v)
+	}
+
+	d := t.Sub(now)
+	future := d > 0
+	if !future {
+		d = -d
+	}
+
+	var span string
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		span = plural(int(d.Minutes()), "minute")
+	case d < 24*time.Hour:
+		span = plural(int(d.Hours()), "hour")
+	default:
+		days := int(math.Round(d.Hours() / 24))
+		if days == 1 {
+			if future {
+				return "tomorrow"
+			}
+			return "yesterday"
+		}
+		span = plural(days, "day")
+	}
+
+	if future {
+		return "in " + span
+	}
+	return span + " ago"
+}
+
+func parse_available(s string, now time.Time) (time.Time, bool) {
+	s = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s), "Available"))
+	for _, layout := range available_layouts {
+		t, err := time.ParseInLocation(layout, s, now.Location())
+		if err != nil {
+			continue
+		}
+
+		// "Mar. 5" has no year, take the next one unless it's only just gone
+		if t.Year() == 0 {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.Before(now.AddDate(0, -1, 0)) {
+				t = t.AddDate(1, 0, 0)
+			}
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// arrow marks what happened to a unit since the last scrape
+func arrow(c history.Change) string {
+	if c.Kind == history.Unchanged || c.Kind == "" {
+		return ""
+	}
+	return change_marker(c)
+}
+
+// price_diff is "$1,700 → $1,650" for a price change, empty otherwise
+func price_diff(c history.Change) string {
+	if c.Kind != history.PriceDrop && c.Kind != history.PriceUp {
+		return ""
+	}
+	return fmt.Sprintf("%s → %s", currency(c.OldRent), currency(c.Unit.Rent))
+}
+
+// Parse_template checks a template parses with the notification helpers
+func Parse_template(text string) (*template.Template, error) {
+	tmpl, err := template.New("notification").Funcs(Template_funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// Render_template runs a template against an alert
+func Render_template(text string, alert Alert) (string, error) {
+	tmpl, err := Parse_template(text)
+	if err != nil {
+		return "", err
+	}
+	return execute(tmpl, alert)
+}
+
+func execute(tmpl *template.Template, alert Alert) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, template_data(alert)); err != nil {
+		return "", fmt.Errorf("rendering template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// Channel_template finds the template for channel: the watch's own, then <channel>.tmpl in Template_dir,
+// then default.tmpl. found is false when the channel should use its built in format
+func Channel_template(alert Alert, channel string) (text string, found bool, err error) {
+	for _, name := range []string{channel, Template_default} {
+		if text, ok := alert.Templates[name]; ok && text != "" {
+			return text, true, nil
+		}
+	}
+
+	if Template_dir == "" {
+		return "", false, nil
+	}
+	for _, name := range []string{channel, Template_default} {
+		// channel can come from a request, it only ever gets to name a file directly in Template_dir
+		path := filepath.Join(Template_dir, name+".tmpl")
+		if filepath.Dir(path) != filepath.Clean(Template_dir) {
+			return "", false, fmt.Errorf("no template for channel %q: the name points outside the template directory", channel)
+		}
+		b, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return string(b), true, nil
+	}
+	return "", false, nil
+}
+
+// render_custom is the channel's template output (or the digest / rule alert text), ok is false when there is no template.
+// a broken template is logged and the channel falls back to its own format rather than dropping the alert
+func render_custom(alert Alert, channel string) (string, bool) {
+	if len(alert.Digest) > 0 {
+		return Render_digest(alert), true
+	}
+	if alert.Trigger != nil {
+		return Render_trigger(alert), true
+	}
+
+	text, found, err := Channel_template(alert, channel)
+	if err == nil && found {
+		var out string
+		if out, err = Render_template(text, alert); err == nil {
+			return strings.TrimSpace(out), true
+		}
+	}
+	if err != nil {
+		log.Printf("%s template: %v, using the built in format\n", channel, err)
+	}
+	return "", false
+}
@@ -0,0 +1,36 @@
+package notify
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChannelTemplateStaysInDir(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "templates")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "slack.tmpl"), []byte("slack {{.Name}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.tmpl"), []byte("not a template"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := Template_dir
+	Template_dir = dir
+	t.Cleanup(func() { Template_dir = saved })
+
+	alert := test_alert("https://www.apartments.com/example/")
+	if text, found, err := Channel_template(alert, "slack"); err != nil || !found || text != "slack {{.Name}}" {
+		t.Errorf("slack: %q, found %v, err %v", text, found, err)
+	}
+
+	for _, channel := range []string{"../secret", "sub/../../secret", "/etc/passwd"} {
+		if text, found, err := Channel_template(alert, channel); err == nil || found {
+			t.Errorf("%s: read %q, found %v, err %v, want it refused", channel, text, found, err)
+		}
+	}
+}
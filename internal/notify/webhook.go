@@ -0,0 +1,390 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	config "github.com/anthonybliss1/go-apts/internal/config"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+	rules "github.com/anthonybliss1/go-apts/internal/rules"
+	store "github.com/anthonybliss1/go-apts/internal/store"
+)
+
+// bump when a field is removed or changes meaning, adding fields doesn't need a new version
+const Event_schema_version = 1
+
+const (
+	Event_listing_scraped    = "listing.scraped"
+	Event_unit_added         = "unit.added"
+	Event_unit_removed       = "unit.removed"
+	Event_unit_price_changed = "unit.price_changed"
+
+	// one per watch rule that fired, see internal/rules
+	Event_rule_price_drop   = "rule.price_drop"
+	Event_rule_under_target = "rule.under_target"
+	Event_rule_cheapest     = "rule.cheapest"
+)
+
+var rule_events = map[string]string{
+	rules.Price_drop:   Event_rule_price_drop,
+	rules.Under_target: Event_rule_under_target,
+	rules.Cheapest:     Event_rule_cheapest,
+}
+
+const (
+	deliveries_bucket = "webhook_deliveries"
+	deliveries_kept   = 50
+)
+
+type Event_listing struct {
+	URL       string       `json:"url"`
+	Name      string       `json:"name"`
+	UnitCount int          `json:"unit_count"`
+	Units     []Event_unit `json:"units,omitempty"` // only on listing.scraped
+}
+
+type Event_unit struct {
+	Name              string  `json:"name"`
+	UnitNumber        string  `json:"unit_number"`
+	Beds              int     `json:"beds"`
+	Baths             float64 `json:"baths"`
+	SquareFeet        float64 `json:"square_feet"`
+	Rent              float64 `json:"rent"`
+	AvailableDateText string  `json:"available_date_text"`
+}
+
+// Event_rule is the rule that fired on rule.* events
+type Event_rule struct {
+	Type         string      `json:"type"`
+	Priority     string      `json:"priority"`
+	PeakRent     float64     `json:"peak_rent,omitempty"`     // rule.price_drop: the highest rent before the drop
+	DropAmount   float64     `json:"drop_amount,omitempty"`   // rule.price_drop
+	DropPercent  float64     `json:"drop_percent,omitempty"`  // rule.price_drop
+	TargetRent   float64     `json:"target_rent,omitempty"`   // rule.under_target
+	Beds         *int        `json:"beds,omitempty"`          // rule.cheapest
+	PreviousUnit *Event_unit `json:"previous_unit,omitempty"` // rule.cheapest: the cheapest unit before, if there was one
+}
+
+// Event is the JSON body of every webhook, documented in the README
+type Event struct {
+	SchemaVersion int           `json:"schema_version"`
+	ID            string        `json:"id"`
+	Type          string        `json:"type"`
+	CreatedAt     time.Time     `json:"created_at"`
+	Listing       Event_listing `json:"listing"`
+	Unit          *Event_unit   `json:"unit,omitempty"`
+	PreviousRent  *float64      `json:"previous_rent,omitempty"` // unit.price_changed only
+	Rule          *Event_rule   `json:"rule,omitempty"`          // rule.* only
+}
+
+// one attempt log per delivered event, newest last
+type Delivery struct {
+	EventID    string
+	EventType  string
+	Endpoint   string
+	Attempts   int
+	StatusCode int
+	Error      string
+	Delivered  bool
+	At         time.Time
+	Duration   time.Duration
+}
+
+// Webhook POSTs signed, versioned JSON events for each change in a scrape
+type Webhook struct {
+	URLs   []string // global endpoints, a watch can replace them with Targets["webhook"] (comma separated)
+	Secret string   // HMAC-SHA256 key, signatures are skipped when empty
+	Client *http.Client
+	Log    *store.Store
+
+	mu sync.Mutex // serialises delivery log updates
+}
+
+func New_webhook(c config.Webhook, log_store *store.Store) (*Webhook, error) {
+	if len(c.URLs) == 0 && !c.Enabled {
+		return nil, fmt.Errorf("webhook urls not set")
+	}
+
+	return &Webhook{
+		URLs:   c.URLs,
+		Secret: c.Secret,
+		Client: &http.Client{Timeout: 15 * time.Second},
+		Log:    log_store,
+	}, nil
+}
+
+func (wh *Webhook) Name() string { return "webhook" }
+
+func event_unit(apt utils.Apartments) *Event_unit {
+	return &Event_unit{
+		Name:              apt.Name,
+		UnitNumber:        apt.UnitNumber,
+		Beds:              apt.Beds,
+		Baths:             apt.Baths,
+		SquareFeet:        apt.SquareFeet,
+		Rent:              apt.Rent,
+		AvailableDateText: apt.AvailableDateText,
+	}
+}
+
+// event_id is the same every time the same alert is sent, so an outbox retry carries the ids the receiver
+// may already have seen and X-Go-Apts-Delivery can be used to drop the repeat. subject tells apart the
+// events of one scrape (the unit, or the rule that fired)
+func event_id(event_type string, alert Alert, subject any) string {
+	b, _ := json.Marshal(struct {
+		Type      string
+		URL       string
+		WatchID   string
+		ScrapedAt int64
+		Subject   any
+	}{event_type, alert.ListingURL, alert.WatchID, alert.ScrapedAt.UnixNano(), subject})
+	sum := sha256.Sum256(b)
+	return "evt_" + hex.EncodeToString(sum[:8])
+}
+
+func new_event(event_type string, alert Alert, subject any) Event {
+	return Event{
+		SchemaVersion: Event_schema_version,
+		ID:            event_id(event_type, alert, subject),
+		Type:          event_type,
+		CreatedAt:     alert.ScrapedAt.UTC(),
+		Listing:       Event_listing{URL: alert.ListingURL, Name: alert.ListingName, UnitCount: len(alert.Units)},
+	}
+}
+
+// Build_events turns a scrape into listing.scraped plus one event per unit that changed
+func Build_events(alert Alert) []Event {
+	// a digest is the events of every listing in it
+	if len(alert.Digest) > 0 {
+		var events []Event
+		for _, part := range alert.Digest {
+			events = append(events, Build_events(part)...)
+		}
+		return events
+	}
+
+	// a rule alert is just its rule event
+	if alert.Trigger != nil {
+		return []Event{rule_event(alert)}
+	}
+
+	scraped := new_event(Event_listing_scraped, alert, nil)
+	scraped.Listing.Units = []Event_unit{}
+	for _, apt := range alert.Units {
+		scraped.Listing.Units = append(scraped.Listing.Units, *event_unit(apt))
+	}
+	events := []Event{scraped}
+
+	for _, apt := range alert.Units {
+		change := alert.Diff.Change_for(apt)
+
+		switch change.Kind {
+		case history.Added:
+			e := new_event(Event_unit_added, alert, history.Unit_key(apt))
+			e.Unit = event_unit(apt)
+			events = append(events, e)
+		case history.PriceDrop, history.PriceUp:
+			e := new_event(Event_unit_price_changed, alert, history.Unit_key(apt))
+			e.Unit = event_unit(apt)
+			old_rent := change.OldRent
+			e.PreviousRent = &old_rent
+			events = append(events, e)
+		}
+	}
+
+	for _, removed := range alert.Diff.Removed {
+		e := new_event(Event_unit_removed, alert, history.Unit_key(removed.Unit))
+		e.Unit = event_unit(removed.Unit)
+		events = append(events, e)
+	}
+	return events
+}
+
+func rule_event(alert Alert) Event {
+	t := alert.Trigger
+	e := new_event(rule_events[t.Rule.Type], alert, struct {
+		Rule rules.Rule
+		Unit string
+	}{t.Rule, history.Unit_key(t.Unit)})
+	e.Rule = &Event_rule{Type: t.Rule.Type, Priority: t.Rule.Priority_name()}
+
+	if t.Unit != (utils.Apartments{}) {
+		e.Unit = event_unit(t.Unit)
+	}
+	switch t.Rule.Type {
+	case rules.Price_drop:
+		e.Rule.PeakRent = t.Peak
+		e.Rule.DropAmount, e.Rule.DropPercent = t.Drop()
+	case rules.Under_target:
+		e.Rule.TargetRent = t.Target
+	case rules.Cheapest:
+		beds := t.Rule.Beds
+		e.Rule.Beds = &beds
+		if t.Previous != (utils.Apartments{}) {
+			e.Rule.PreviousUnit = event_unit(t.Previous)
+		}
+	}
+	return e
+}
+
+// Sign is the X-Go-Apts-Signature value: hex HMAC-SHA256 of "<timestamp>.<body>"
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *Webhook) Send(ctx context.Context, alert Alert) error {
+	urls := wh.URLs
+	if target := alert.Targets[wh.Name()]; target != "" {
+		urls = split_addresses(target)
+	}
+	if len(urls) == 0 {
+		return utils.New_error(utils.ErrNotifier, "no webhook endpoints configured for this watch", nil)
+	}
+
+	var failed []string
+	for _, event := range Build_events(alert) {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("marshal webhook event: %w", err)
+		}
+
+		for _, endpoint := range urls {
+			// an outbox retry only goes to the endpoints that didn't take the event last time
+			dest := endpoint + " " + event.ID
+			if already_delivered(ctx, dest) {
+				continue
+			}
+			if d := wh.deliver(ctx, endpoint, event, body); !d.Delivered {
+				name := redact_endpoint(endpoint)
+				failed = append(failed, fmt.Sprintf("%s %s: %s", event.Type, name, strings.ReplaceAll(d.Error, endpoint, name)))
+				continue
+			}
+			mark_delivered(ctx, dest)
+		}
+	}
+
+	if len(failed) > 0 {
+		return utils.New_error(utils.ErrNotifier, "webhook deliveries failed", fmt.Errorf("%s", strings.Join(failed, "; ")))
+	}
+	return nil
+}
+
+// one try per endpoint and event. a failed send fails the whole alert and the outbox retries it later with
+// the same event ids, retrying here too would hold up /chat for as long as a dead endpoint takes to time out
+func (wh *Webhook) deliver(ctx context.Context, endpoint string, event Event, body []byte) Delivery {
+	d := Delivery{EventID: event.ID, EventType: event.Type, Endpoint: endpoint, At: time.Now(), Attempts: 1}
+	if err := wh.post(ctx, endpoint, event, body, &d); err != nil {
+		d.Error = err.Error()
+	} else {
+		d.Delivered = true
+	}
+
+	d.Duration = time.Since(d.At)
+	wh.record(d)
+	return d
+}
+
+func (wh *Webhook) post(ctx context.Context, endpoint string, event Event, body []byte, d *Delivery) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building webhook request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-apts-webhooks/1")
+	req.Header.Set("X-Go-Apts-Event", event.Type)
+	req.Header.Set("X-Go-Apts-Delivery", event.ID)
+	req.Header.Set("X-Go-Apts-Timestamp", timestamp)
+	if wh.Secret != "" {
+		req.Header.Set("X-Go-Apts-Signature", Sign(wh.Secret, timestamp, body))
+	}
+
+	resp, err := wh.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	d.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return fmt.Errorf("received status code %d", resp.StatusCode)
+}
+
+func (wh *Webhook) record(d Delivery) {
+	if wh.Log == nil {
+		return
+	}
+
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	var entries []Delivery
+	if _, err := wh.Log.Get(deliveries_bucket, d.Endpoint, &entries); err != nil {
+		log.Printf("reading webhook delivery log: %v\n", err)
+	}
+	entries = append(entries, d)
+	if len(entries) > deliveries_kept {
+		entries = entries[len(entries)-deliveries_kept:]
+	}
+	if err := wh.Log.Put(deliveries_bucket, d.Endpoint, entries); err != nil {
+		log.Printf("saving webhook delivery log: %v\n", err)
+	}
+}
+
+// Deliveries returns the recent delivery log of every endpoint, keyed by redact_endpoint so the
+// tokens a lot of receivers keep in their URL don't end up in whatever is reading this
+func (wh *Webhook) Deliveries() map[string][]Delivery {
+	all := make(map[string][]Delivery)
+	if wh.Log == nil {
+		return all
+	}
+
+	for _, endpoint := range wh.Log.Keys(deliveries_bucket) {
+		var entries []Delivery
+		if _, err := wh.Log.Get(deliveries_bucket, endpoint, &entries); err != nil {
+			continue
+		}
+		name := redact_endpoint(endpoint)
+		for i := range entries {
+			entries[i].Endpoint = name
+			// client.Do errors quote the whole URL
+			entries[i].Error = strings.ReplaceAll(entries[i].Error, endpoint, name)
+		}
+		all[name] = entries
+	}
+	return all
+}
+
+// redact_endpoint keeps the scheme and host and swaps the rest for a short hash, enough to tell
+// two endpoints on the same host apart without showing their path or query
+func redact_endpoint(endpoint string) string {
+	sum := sha256.Sum256([]byte(endpoint))
+	hash := hex.EncodeToString(sum[:4])
+
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Host == "" {
+		return hash
+	}
+	return parsed.Scheme + "://" + parsed.Host + "#" + hash
+}
@@ -0,0 +1,191 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	store "github.com/anthonybliss1/go-apts/internal/store"
+)
+
+func TestBuildEvents(t *testing.T) {
+	alert := changed_alert()
+	events := Build_events(alert)
+
+	want := []string{Event_listing_scraped, Event_unit_added, Event_unit_price_changed, Event_unit_removed}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+
+	ids := make(map[string]bool)
+	for i, e := range events {
+		if e.Type != want[i] {
+			t.Errorf("event %d is %s, want %s", i, e.Type, want[i])
+		}
+		if e.SchemaVersion != Event_schema_version {
+			t.Errorf("%s: schema_version %d", e.Type, e.SchemaVersion)
+		}
+		if ids[e.ID] {
+			t.Errorf("%s: id %s used twice", e.Type, e.ID)
+		}
+		ids[e.ID] = true
+	}
+
+	if n := len(events[0].Listing.Units); n != 3 {
+		t.Errorf("listing.scraped has %d units, want 3", n)
+	}
+	if p := events[2].PreviousRent; p == nil || *p != 1725 {
+		t.Errorf("previous_rent = %v, want 1725", p)
+	}
+
+	// a retry of the same alert has to carry the same ids, or receivers can't drop the repeat
+	for i, e := range Build_events(alert) {
+		if e.ID != events[i].ID {
+			t.Errorf("%s: id changed from %s to %s", e.Type, events[i].ID, e.ID)
+		}
+	}
+
+	// the next scrape is new events
+	later := alert
+	later.ScrapedAt = alert.ScrapedAt.Add(time.Hour)
+	if Build_events(later)[0].ID == events[0].ID {
+		t.Error("a later scrape reused the listing.scraped id")
+	}
+}
+
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+func TestWebhookSendSigns(t *testing.T) {
+	var mu sync.Mutex
+	var got []received
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, received{r.Header.Clone(), body})
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	wh := &Webhook{URLs: []string{server.URL}, Secret: "s3cret", Client: server.Client(), Log: store.Memory()}
+	alert := changed_alert()
+	if err := wh.Send(context.Background(), alert); err != nil {
+		t.Fatal(err)
+	}
+
+	events := Build_events(alert)
+	if len(got) != len(events) {
+		t.Fatalf("received %d posts, want %d", len(got), len(events))
+	}
+	for i, r := range got {
+		var e Event
+		if err := json.Unmarshal(r.body, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.ID != events[i].ID || r.header.Get("X-Go-Apts-Delivery") != e.ID {
+			t.Errorf("post %d: id %s, delivery header %s, want %s", i, e.ID, r.header.Get("X-Go-Apts-Delivery"), events[i].ID)
+		}
+		if r.header.Get("X-Go-Apts-Event") != e.Type {
+			t.Errorf("post %d: event header %q, want %q", i, r.header.Get("X-Go-Apts-Event"), e.Type)
+		}
+
+		timestamp := r.header.Get("X-Go-Apts-Timestamp")
+		if timestamp == "" {
+			t.Fatalf("post %d: no timestamp", i)
+		}
+		want := Sign("s3cret", timestamp, r.body)
+		if !hmac.Equal([]byte(r.header.Get("X-Go-Apts-Signature")), []byte(want)) {
+			t.Errorf("post %d: signature %q, want %q", i, r.header.Get("X-Go-Apts-Signature"), want)
+		}
+	}
+
+	// what a receiver computes from the README: hex HMAC-SHA256 of "<timestamp>.<body>"
+	want := "sha256=9d713ed406bb7076d4123f0dc2c39d2df5c654ed4b0cd56b52c8b4c940bd63ae"
+	if sig := Sign("key", "1700000000", []byte("{}")); sig != want {
+		t.Errorf("Sign = %q, want %q", sig, want)
+	}
+}
+
+func TestWebhookRetryOnlyFailedEndpoints(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	down := true
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			hits[name]++
+			if name == "flaky" && down {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}
+	}
+	ok := httptest.NewServer(handler("ok"))
+	defer ok.Close()
+	flaky := httptest.NewServer(handler("flaky"))
+	defer flaky.Close()
+
+	wh := &Webhook{URLs: []string{ok.URL, flaky.URL}, Client: &http.Client{Timeout: 5 * time.Second}}
+	alert := test_alert("https://www.apartments.com/example/")
+	ctx, progress := with_delivered(context.Background(), nil)
+
+	// one try per endpoint, the outbox does the retrying
+	if err := wh.Send(ctx, alert); err == nil {
+		t.Fatal("send with a failing endpoint succeeded")
+	}
+	if hits["ok"] != 1 || hits["flaky"] != 1 {
+		t.Fatalf("hits after the first send: %v, want one each", hits)
+	}
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	retry, _ := with_delivered(context.Background(), progress.list())
+	if err := wh.Send(retry, alert); err != nil {
+		t.Fatal(err)
+	}
+	if hits["ok"] != 1 || hits["flaky"] != 2 {
+		t.Errorf("hits after the retry: %v, the working endpoint shouldn't get the event again", hits)
+	}
+}
+
+func TestWebhookDeliveriesHideEndpointPaths(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	endpoint := server.URL + "/hooks/T0KEN?key=s3cret"
+	wh := &Webhook{URLs: []string{endpoint, "http://127.0.0.1:1/hooks/T0KEN"}, Client: server.Client(), Log: store.Memory()}
+	err := wh.Send(context.Background(), test_alert("https://www.apartments.com/example/"))
+	if err == nil {
+		t.Fatal("send to failing endpoints succeeded")
+	}
+	if strings.Contains(err.Error(), "T0KEN") {
+		t.Errorf("send error shows an endpoint path: %v", err)
+	}
+
+	deliveries := wh.Deliveries()
+	if len(deliveries) != 2 {
+		t.Fatalf("got deliveries for %d endpoints, want 2", len(deliveries))
+	}
+	for name, entries := range deliveries {
+		if !strings.HasPrefix(name, "http://127.0.0.1:") || !strings.Contains(name, "#") {
+			t.Errorf("endpoint listed as %q, want scheme, host and a hash", name)
+		}
+		for _, d := range entries {
+			if strings.Contains(d.Endpoint+d.Error, "T0KEN") || strings.Contains(d.Endpoint+d.Error, "s3cret") {
+				t.Errorf("delivery shows the endpoint path: %+v", d)
+			}
+		}
+	}
+}
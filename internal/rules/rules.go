@@ -0,0 +1,216 @@
+package rules
+
+import (
+	"fmt"
+	"sort"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	history "github.com/anthonybliss1/go-apts/internal/history"
+)
+
+// rule types, each one is its own kind of alert
+const (
+	Price_drop   = "price_drop"   // a unit's rent fell far enough below the highest it was listed at
+	Under_target = "under_target" // a unit's rent is at or under a target rent
+	Cheapest     = "cheapest"     // the building's cheapest unit with some number of beds changed
+)
+
+// priorities a rule can send at, high unless it says otherwise
+const (
+	Priority_low     = "low"
+	Priority_default = "default"
+	Priority_high    = "high"
+)
+
+// Rule is a trigger on a watch, checked against the listing's stored rent history on every scrape
+type Rule struct {
+	Type        string
+	DropAmount  float64  // price_drop: fires once rent is this many dollars under the unit's highest rent
+	DropPercent float64  // price_drop: or this percent under it, whichever comes first
+	TargetRent  float64  // under_target: the watch's TargetRent when 0
+	Beds        int      // cheapest: number of bedrooms, 0 for studios
+	Priority    string   // low, default or high (the default)
+	Channels    []string // where this rule's alerts go, the watch's channels when empty
+}
+
+// Trigger is a rule that fired on a scrape
+type Trigger struct {
+	Rule     Rule
+	Unit     utils.Apartments // the unit it fired for. cheapest: the new cheapest, zero when there are none left
+	Previous utils.Apartments // cheapest: the cheapest one before, zero when there wasn't one
+	Peak     float64          // price_drop: the highest rent the unit was listed at before
+	Target   float64          // under_target: the target rent it went under
+}
+
+// Validate names the first field that's wrong
+func (r Rule) Validate() error {
+	switch r.Type {
+	case Price_drop:
+		if r.DropAmount <= 0 && r.DropPercent <= 0 {
+			return fmt.Errorf("DropAmount or DropPercent is required for a price_drop rule")
+		}
+		if r.DropAmount < 0 {
+			return fmt.Errorf("DropAmount can't be negative, got %v", r.DropAmount)
+		}
+		if r.DropPercent < 0 || r.DropPercent >= 100 {
+			return fmt.Errorf("DropPercent must be between 0 and 100, got %v", r.DropPercent)
+		}
+	case Under_target:
+		if r.TargetRent < 0 {
+			return fmt.Errorf("TargetRent can't be negative, got %v", r.TargetRent)
+		}
+	case Cheapest:
+		if r.Beds < 0 {
+			return fmt.Errorf("Beds can't be negative, got %d", r.Beds)
+		}
+	default:
+		return fmt.Errorf("Type must be %s, %s or %s, got %q", Price_drop, Under_target, Cheapest, r.Type)
+	}
+
+	switch r.Priority {
+	case "", Priority_low, Priority_default, Priority_high:
+	default:
+		return fmt.Errorf("Priority must be low, default or high, got %q", r.Priority)
+	}
+	return nil
+}
+
+// Priority_name is the rule's priority, high when it doesn't set one
+func (r Rule) Priority_name() string {
+	if r.Priority == "" {
+		return Priority_high
+	}
+	return r.Priority
+}
+
+// Drop is how far below its peak the unit is, in dollars and percent
+func (t Trigger) Drop() (amount float64, percent float64) {
+	if t.Peak <= 0 {
+		return 0, 0
+	}
+	amount = t.Peak - t.Unit.Rent
+	return amount, amount / t.Peak * 100
+}
+
+// Evaluate is every rule that fired on a scrape: units are the units in it (muted ones left out) and diff
+// is what the stored history says changed. rules only fire when something crosses their line, so the same
+// state doesn't alert again on every check. target_rent is the watch's, for under_target rules without one
+func Evaluate(rules []Rule, units []utils.Apartments, diff history.Diff, target_rent float64) []Trigger {
+	var triggers []Trigger
+	for _, rule := range rules {
+		switch rule.Type {
+		case Price_drop:
+			triggers = append(triggers, price_drops(rule, units, diff)...)
+		case Under_target:
+			target := rule.TargetRent
+			if target == 0 {
+				target = target_rent
+			}
+			if target > 0 {
+				triggers = append(triggers, under_target(rule, target, units, diff)...)
+			}
+		case Cheapest:
+			if t, ok := cheapest_changed(rule, units, diff); ok {
+				triggers = append(triggers, t)
+			}
+		}
+	}
+	return triggers
+}
+
+func dropped(rule Rule, peak float64, rent float64) bool {
+	if peak <= 0 || rent <= 0 || rent >= peak {
+		return false
+	}
+	drop := peak - rent
+	return (rule.DropAmount > 0 && drop >= rule.DropAmount) || (rule.DropPercent > 0 && drop/peak*100 >= rule.DropPercent)
+}
+
+// fires on the scrape where the drop from the peak first reaches the threshold. a relisted unit comes back
+// as Added with its old peak, so coming back cheaper counts too
+func price_drops(rule Rule, units []utils.Apartments, diff history.Diff) []Trigger {
+	var triggers []Trigger
+	for _, apt := range units {
+		change := diff.Change_for(apt)
+		if change.Kind != history.PriceDrop && change.Kind != history.Added {
+			continue
+		}
+		if dropped(rule, change.Peak, apt.Rent) && !dropped(rule, change.Peak, change.OldRent) {
+			triggers = append(triggers, Trigger{Rule: rule, Unit: apt, Peak: change.Peak})
+		}
+	}
+	return triggers
+}
+
+// fires for new units at or under the target and ones whose rent just went under it
+func under_target(rule Rule, target float64, units []utils.Apartments, diff history.Diff) []Trigger {
+	var triggers []Trigger
+	for _, apt := range units {
+		if apt.Rent <= 0 || apt.Rent > target {
+			continue
+		}
+		change := diff.Change_for(apt)
+		if change.Kind == history.Added || (change.Kind == history.PriceDrop && change.OldRent > target) {
+			triggers = append(triggers, Trigger{Rule: rule, Unit: apt, Target: target})
+		}
+	}
+	return triggers
+}
+
+// cheapest unit with beds bedrooms and a rent, ties go to the lowest unit key so it doesn't flip between scrapes
+func cheapest(units []utils.Apartments, beds int) (utils.Apartments, bool) {
+	var matching []utils.Apartments
+	for _, apt := range units {
+		if apt.Beds == beds && apt.Rent > 0 {
+			matching = append(matching, apt)
+		}
+	}
+	if len(matching) == 0 {
+		return utils.Apartments{}, false
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		if matching[i].Rent != matching[j].Rent {
+			return matching[i].Rent < matching[j].Rent
+		}
+		return history.Unit_key(matching[i]) < history.Unit_key(matching[j])
+	})
+	return matching[0], true
+}
+
+// previous_units is the last scrape as the diff remembers it: units still listed at their old rent, plus the gone ones
+func previous_units(units []utils.Apartments, diff history.Diff) []utils.Apartments {
+	var prev []utils.Apartments
+	for _, apt := range units {
+		change := diff.Change_for(apt)
+		if change.Kind == history.Added {
+			continue
+		}
+		if change.OldRent > 0 {
+			apt.Rent = change.OldRent
+		}
+		prev = append(prev, apt)
+	}
+	for _, gone := range diff.Removed {
+		prev = append(prev, gone.Unit)
+	}
+	return prev
+}
+
+// fires when the cheapest unit is a different one or at a different rent than on the last scrape
+func cheapest_changed(rule Rule, units []utils.Apartments, diff history.Diff) (Trigger, bool) {
+	// nothing to compare the first scrape with
+	if diff.First {
+		return Trigger{}, false
+	}
+
+	before, had := cheapest(previous_units(units, diff), rule.Beds)
+	now, has := cheapest(units, rule.Beds)
+	if !had && !has {
+		return Trigger{}, false
+	}
+	if had && has && history.Unit_key(before) == history.Unit_key(now) && before.Rent == now.Rent {
+		return Trigger{}, false
+	}
+	return Trigger{Rule: rule, Unit: now, Previous: before}, true
+}
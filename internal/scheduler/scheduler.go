@@ -0,0 +1,95 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	notify "github.com/anthonybliss1/go-apts/internal/notify"
+	watch "github.com/anthonybliss1/go-apts/internal/watch"
+)
+
+// how often the scheduler looks for due watches
+const tick = time.Minute
+
+// Scheduler runs watches that have an Interval from inside the service, instead of a cron script per listing
+type Scheduler struct {
+	Watches *watch.Watches
+	Client  *http.Client
+}
+
+func New(watches *watch.Watches, client *http.Client) *Scheduler {
+	return &Scheduler{Watches: watches, Client: client}
+}
+
+// Run checks for due watches and digests every minute until ctx is done. a run that's already going
+// when ctx is done (on shutdown) is finished rather than cut off half way through its sends
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		s.run_due(ctx)
+		// digests and alerts held over quiet hours
+		if ctx.Err() == nil {
+			notify.Digests.Flush(context.WithoutCancel(ctx), time.Now())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// due watches run one after another, they all go through the same per-host rate limiter anyway
+func (s *Scheduler) run_due(ctx context.Context) {
+	all, err := s.Watches.List()
+	if err != nil {
+		log.Printf("scheduler: listing watches: %v\n", err)
+		return
+	}
+
+	now := time.Now()
+	for _, wt := range all {
+		if ctx.Err() != nil {
+			return
+		}
+		if !wt.Due(now) {
+			continue
+		}
+		s.Run_watch(context.WithoutCancel(ctx), wt)
+	}
+}
+
+// Run_watch sends wt now and records how it went
+func (s *Scheduler) Run_watch(ctx context.Context, wt watch.Watch) error {
+	err := notify.Send_watch(ctx, wt, s.Client, false)
+
+	// still queued for a scrape when go-apts stopped, it didn't run so it stays due for the next start
+	if errors.Is(err, utils.ErrShuttingDown) {
+		return err
+	}
+
+	// re-read so a /pause or edit that happened during the scrape isn't overwritten
+	latest, found, get_err := s.Watches.Get(wt.ID)
+	if get_err != nil || !found {
+		return err
+	}
+
+	latest.LastRun = time.Now()
+	latest.LastError = ""
+	if err != nil {
+		latest.LastError = err.Error()
+		log.Printf("scheduler: watch %s (%s): %v\n", wt.ID, wt.URL, err)
+	}
+
+	if save_err := s.Watches.Save(latest); save_err != nil {
+		log.Printf("scheduler: saving watch %s: %v\n", wt.ID, save_err)
+	}
+	return err
+}
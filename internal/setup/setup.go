@@ -2,9 +2,10 @@ package setup
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -14,10 +15,28 @@ import (
 	"strings"
 	"time"
 
+	config "github.com/anthonybliss1/go-apts/internal/config"
+	notify "github.com/anthonybliss1/go-apts/internal/notify"
+	store "github.com/anthonybliss1/go-apts/internal/store"
+	subscribers "github.com/anthonybliss1/go-apts/internal/subscribers"
+	watch "github.com/anthonybliss1/go-apts/internal/watch"
 	"github.com/joho/godotenv"
 )
 
-func Create_bash(op_sys string, url string) (script string, err error) {
+// local_base is the address a script on this machine reaches the server on. listen is server.listen,
+// where an empty or 0.0.0.0 / :: host means every interface, so the script goes through loopback
+func local_base(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "http://127.0.0.1:8000"
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+func Create_bash(op_sys string, listen string, url string) (script string, err error) {
 	if op_sys == "linux" || op_sys == "darwin" {
 		script = `#!/bin/bash
 
@@ -38,7 +57,7 @@ if ! command -v curl >/dev/null 2>&1; then
 	fi
 fi
 
-curl -X POST "http://127.0.0.1:8000/chat?url=` + url + `"
+curl -X POST "` + local_base(listen) + `/chat?url=` + url + `"
 `
 
 	} else {
@@ -47,8 +66,58 @@ curl -X POST "http://127.0.0.1:8000/chat?url=` + url + `"
 	return script, nil
 }
 
-func Setup_telegram_bot() (bot_token string, chat_id string, err error) {
-	var chat_started string
+// a chat the bot has seen in getUpdates, thread_id set when it was a forum topic
+type discovered_chat struct {
+	chat      notify.Telegram_chat
+	thread_id int
+}
+
+func (d discovered_chat) label() string {
+	name := d.chat.Title
+	if name == "" && d.chat.Username != "" {
+		name = "@" + d.chat.Username
+	}
+	if name == "" {
+		name = d.chat.FirstName
+	}
+
+	label := fmt.Sprintf("%s (%s, id %d)", name, d.chat.Type, d.chat.ID)
+	if d.thread_id != 0 {
+		label += fmt.Sprintf(" topic %d", d.thread_id)
+	}
+	return label
+}
+
+// every distinct chat / topic in the pending updates, in the order they were seen
+func discover_chats(updates []notify.Update) []discovered_chat {
+	var chats []discovered_chat
+	seen := map[string]bool{}
+
+	for _, u := range updates {
+		var found discovered_chat
+		switch {
+		case u.Message != nil:
+			found = discovered_chat{chat: u.Message.Chat, thread_id: u.Message.MessageThreadID}
+		case u.ChannelPost != nil:
+			found = discovered_chat{chat: u.ChannelPost.Chat}
+		case u.MyChatMember != nil:
+			found = discovered_chat{chat: u.MyChatMember.Chat}
+		default:
+			continue
+		}
+
+		key := subscribers.Target_key(strconv.FormatInt(found.chat.ID, 10), found.thread_id)
+		if !seen[key] {
+			seen[key] = true
+			chats = append(chats, found)
+		}
+	}
+	return chats
+}
+
+// Setup_telegram_bot lists the chats the bot has seen and returns the ones picked to get alerts, the first is the default chat
+func Setup_telegram_bot() (bot_token string, picked []subscribers.Subscriber, err error) {
+	var chat_started, picks string
 
 	fmt.Println("\nBeginning Telegram Bot Setup...")
 	fmt.Println("> Open Telegram")
@@ -57,6 +126,7 @@ func Setup_telegram_bot() (bot_token string, chat_id string, err error) {
 	fmt.Print("> Enter the bot token here: ")
 	fmt.Scan(&bot_token)
 	fmt.Println("> Click the t.me/<yourbotname> link that BotFather provided, press 'Start' to begin a chat, and send it a message")
+	fmt.Println("> To get alerts in a group, channel or forum topic too, add the bot there and post a message in it")
 
 	for {
 		fmt.Print("> Have you sent your bot a message? (y / n) ")
@@ -72,50 +142,91 @@ func Setup_telegram_bot() (bot_token string, chat_id string, err error) {
 		}
 	}
 
-	fmt.Println("> Fetching Chat ID...")
+	fmt.Println("> Fetching chats...")
 
-	get_updates_url := fmt.Sprintf("https://api.telegram.org/bot%s/getUpdates", bot_token)
+	t := &notify.Telegram{BotToken: bot_token, APIBase: "https://api.telegram.org", Client: &http.Client{Timeout: 30 * time.Second}}
 
-	resp, err := http.Get(get_updates_url)
-	if err != nil {
-		return "", "", err
+	var updates []notify.Update
+	payload := map[string]any{"allowed_updates": []string{"message", "channel_post", "my_chat_member"}}
+	if err := t.Call(context.Background(), "getUpdates", payload, &updates); err != nil {
+		return "", nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("get_updates_url returned %d", resp.StatusCode)
+	chats := discover_chats(updates)
+	if len(chats) == 0 {
+		return "", nil, fmt.Errorf("no messages found in chat. Please send your bot a message")
 	}
 
-	var payload map[string]interface{}
-
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return "", "", fmt.Errorf("decoding getUpdates JSON: %w", err)
+	fmt.Println("\n> Chats the bot can see:")
+	for i, c := range chats {
+		fmt.Printf("  %d) %s\n", i+1, c.label())
 	}
 
-	//fmt.Printf("Raw getUpdates payload: %+v\n", payload)
+	for len(picked) == 0 {
+		fmt.Print("> Which should get alerts? Comma separated numbers, the first is the default chat (e.g. 1,3): ")
+		fmt.Scan(&picks)
 
-	resultArr, _ := payload["result"].([]interface{})
-	if len(resultArr) == 0 {
-		return "", "", fmt.Errorf("no messages found in chat. Please send your bot a message")
+		for _, pick := range strings.Split(picks, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(pick))
+			if err != nil || n < 1 || n > len(chats) {
+				fmt.Printf("> %q isn't one of the chats above\n", pick)
+				picked = nil
+				break
+			}
+			c := chats[n-1]
+			picked = append(picked, subscribers.Subscriber{
+				ChatID:   strconv.FormatInt(c.chat.ID, 10),
+				ThreadID: c.thread_id,
+				Title:    c.label(),
+				Type:     c.chat.Type,
+			})
+		}
 	}
 
-	last := resultArr[len(resultArr)-1].(map[string]interface{})
+	fmt.Printf("\n> Default Chat ID: %s\n", picked[0].ChatID)
+	fmt.Println("> Storing Bot Token and Chat ID in environment variables...")
 
-	msg_obj, _ := last["message"].(map[string]interface{})
-	chat_obj, _ := msg_obj["chat"].(map[string]interface{})
-	float_id, _ := chat_obj["id"].(float64)
+	fmt.Println("\n> Telegram Bot Sucessfully Enabled!")
 
-	chat_id = strconv.FormatFloat(float_id, 'f', 0, 64)
+	return bot_token, picked, nil
+}
 
-	fmt.Printf("\n> Retrieved Chat ID: %s\n", chat_id)
-	fmt.Println("> Storing Bot Token and Chat ID in environment variables...")
+// subscribe_chats asks which watches each picked chat should get and saves them as subscribers
+func subscribe_chats(st *store.Store, picked []subscribers.Subscriber) error {
+	all, err := watch.New(st).List()
+	if err != nil {
+		return err
+	}
 
-	fmt.Println("\n> Telegram Bot Sucessfully Enabled!")
+	if len(all) > 0 {
+		fmt.Println("\n> Current watches:")
+		for _, wt := range all {
+			fmt.Printf("  %s  %s\n", wt.ID, wt.URL)
+		}
+	}
+
+	subs := subscribers.New(st)
+	for _, sub := range picked {
+		sub.Watches = []string{subscribers.All}
 
-	return bot_token, chat_id, nil
+		if len(all) > 0 {
+			var answer string
+			fmt.Printf("> Which watches should %s get? (all / comma separated ids) ", sub.Title)
+			fmt.Scan(&answer)
+			if !strings.EqualFold(answer, "all") {
+				sub.Watches = strings.Split(answer, ",")
+			}
+		}
+
+		if err := subs.Save(sub); err != nil {
+			return fmt.Errorf("saving telegram subscriber %s: %w", sub.Key(), err)
+		}
+	}
+	return nil
 }
 
-func Setup_systemd() error {
+// the service is started with --config, so it reads the same file no matter which user or directory it runs from
+func Setup_systemd(config_path string) error {
 	const systemd_template = `[Unit]
 	Description=go-apts service
 	After=network.target
@@ -124,6 +235,7 @@ func Setup_systemd() error {
 	WorkingDirectory=%s
 	ExecStart=%s
 	Restart=on-failure
+	TimeoutStopSec=90
 
 	[Install]
 	WantedBy=multi-user.target
@@ -137,7 +249,12 @@ func Setup_systemd() error {
 	binary_path, _ := filepath.Abs(os.Args[0])
 	binary_dir := filepath.Dir(binary_path)
 
-	unitText := fmt.Sprintf(systemd_template, binary_dir, binary_path)
+	exec_start := binary_path
+	if config_path != "" {
+		exec_start = fmt.Sprintf("%s --config %q", binary_path, config_path)
+	}
+
+	unitText := fmt.Sprintf(systemd_template, binary_dir, exec_start)
 
 	unit_path := "/etc/systemd/system/go-apts.service"
 	if err := os.WriteFile(unit_path, []byte(unitText), 0o644); err != nil {
@@ -160,7 +277,7 @@ func Setup_systemd() error {
 	return nil
 }
 
-func Setup_launchd() error {
+func Setup_launchd(config_path string) error {
 	label := "com.go-apts.agent"
 
 	home, err := os.UserHomeDir()
@@ -190,6 +307,8 @@ func Setup_launchd() error {
   <key>ProgramArguments</key>
   <array>
     <string>%s</string>
+    <string>--config</string>
+    <string>%s</string>
   </array>
 
   <key>WorkingDirectory</key>
@@ -209,6 +328,7 @@ func Setup_launchd() error {
 </plist>`,
 		label,
 		binary_path,
+		config_path,
 		binary_dir,
 		filepath.Join(home, "Library", "Logs", "go-apts.log"),
 		filepath.Join(home, "Library", "Logs", "go-apts.log"),
@@ -232,7 +352,7 @@ func Setup_launchd() error {
 	return nil
 }
 
-func Setup_scheduled_task() error {
+func Setup_scheduled_task(listen string) error {
 	var op_sys, url, cron_dir, script_name, cron_spec string
 	var timing int
 	var new_crontab bytes.Buffer
@@ -249,7 +369,7 @@ func Setup_scheduled_task() error {
 	fmt.Scan(&url)
 
 	fmt.Println("\n> Building Bash Script...")
-	script, err := Create_bash(op_sys, url)
+	script, err := Create_bash(op_sys, listen, url)
 	if err != nil {
 		return fmt.Errorf("making bash: %q", err)
 	}
@@ -347,21 +467,26 @@ func Setup_scheduled_task() error {
 	return nil
 }
 
-func Setup_go_apts() error {
+// Setup_go_apts asks for what's missing from cfg and saves the answers to the .env next to config_path,
+// which go-apts reads on top of the config file
+func Setup_go_apts(st *store.Store, cfg config.Config, config_path string) error {
 	var proxies_enabled, telegram_enabled, telly_setup, bot_token, chat_id, always_on_enabled, sch_task_enabled, op_sys string
+	var picked []subscribers.Subscriber
 	var err error
 
-	m, _ := godotenv.Read(".env")
+	env_path := config.Env_path(config_path)
+	if err := os.MkdirAll(filepath.Dir(env_path), 0o755); err != nil {
+		return fmt.Errorf("creating config directory: %w", err)
+	}
+
+	m, _ := godotenv.Read(env_path)
 	op_sys = runtime.GOOS
 
 	fmt.Print("\n\nDo you want to enable proxies with OxyLabs? Proxies help avoid IP blocking (y / n) ")
 	fmt.Scan(&proxies_enabled)
 	if strings.EqualFold(proxies_enabled, "y") {
-		oxy_name, _ := os.LookupEnv("OXYLABS_USERNAME")
-		oxy_pass, _ := os.LookupEnv("OXYLABS_PASSWORD")
-		oxy_host, _ := os.LookupEnv("OXYLABS_PROXY_HOST")
-		oxy_port, _ := os.LookupEnv("OXYLABS_PROXY_PORT")
-		if oxy_name != "" || oxy_pass != "" || oxy_host != "" || oxy_port != "" {
+		oxy := cfg.Proxies
+		if oxy.Username != "" || oxy.Password != "" || oxy.Host != "" || oxy.Port != "" {
 		} else {
 			proxies_enabled = "n"
 			fmt.Println("\nUnable to locate all OxyLabs credentials")
@@ -375,7 +500,7 @@ func Setup_go_apts() error {
 	fmt.Scan(&telegram_enabled)
 
 	if strings.EqualFold(telegram_enabled, "y") {
-		telly_test := os.Getenv("TELEGRAM_BOT_TOKEN")
+		telly_test := cfg.Notifiers.Telegram.BotToken
 
 		if telly_test == "" {
 			fmt.Println("\nYou must setup a Telgram bot and add your credentials")
@@ -383,13 +508,17 @@ func Setup_go_apts() error {
 			fmt.Scan(&telly_setup)
 
 			if strings.EqualFold(telly_setup, "y") {
-				bot_token, chat_id, err = Setup_telegram_bot()
+				bot_token, picked, err = Setup_telegram_bot()
 				if err != nil {
 					return fmt.Errorf("error during Telegram bot setup: %q", err)
 				}
+				chat_id = picked[0].ChatID
+				if err := subscribe_chats(st, picked); err != nil {
+					return err
+				}
 				m["TELEGRAM_BOT_TOKEN"] = bot_token
 				m["TELEGRAM_CHAT_ID"] = chat_id
-				if err := godotenv.Write(m, ".env"); err != nil {
+				if err := godotenv.Write(m, env_path); err != nil {
 					return fmt.Errorf("failed to write telegram variables to .env: %q", err)
 				}
 				telegram_enabled = "y"
@@ -402,7 +531,7 @@ func Setup_go_apts() error {
 	m["proxies_enabled"] = proxies_enabled
 	m["telegram_enabled"] = telegram_enabled
 
-	if err := godotenv.Write(m, ".env"); err != nil {
+	if err := godotenv.Write(m, env_path); err != nil {
 		return fmt.Errorf("failed to write proxies_enabled and telegram_enabled to .env: %q", err)
 	}
 
@@ -411,7 +540,7 @@ func Setup_go_apts() error {
 	os.Setenv("proxies_enabled", proxies_enabled)
 	os.Setenv("telegram_enabled", telegram_enabled)
 
-	godotenv.Load(".env")
+	fmt.Printf("\n> Saved to %s\n", env_path)
 
 	fmt.Print("\nDo you want to setup Go Apts as an always on service? (y / n) ")
 	fmt.Scan(&always_on_enabled)
@@ -419,11 +548,11 @@ func Setup_go_apts() error {
 	if strings.EqualFold(always_on_enabled, "y") {
 		switch op_sys {
 		case "linux":
-			if err := Setup_systemd(); err != nil {
+			if err := Setup_systemd(config_path); err != nil {
 				log.Fatal(err)
 			}
 		case "darwin":
-			if err := Setup_launchd(); err != nil {
+			if err := Setup_launchd(config_path); err != nil {
 				log.Fatal(err)
 			}
 		default:
@@ -436,7 +565,7 @@ func Setup_go_apts() error {
 		fmt.Scan(&sch_task_enabled)
 
 		if strings.EqualFold(sch_task_enabled, "y") {
-			if err := Setup_scheduled_task(); err != nil {
+			if err := Setup_scheduled_task(cfg.Server.Listen); err != nil {
 				return err
 			} else {
 				log.Fatal()
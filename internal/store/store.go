@@ -0,0 +1,151 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// where the store lives when storage.store isn't set, relative to the working directory
+const Default_path = "go-apts-store.json"
+
+// Store is a small JSON file of named buckets of key -> value. it's plenty for a handful of watches and
+// keeps go-apts a single binary with no database to set up
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	buckets map[string]map[string]json.RawMessage
+	dirty   bool
+	closed  bool // after Close, changes stay in memory so nothing writes while the process exits
+}
+
+// an empty path keeps everything in memory
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, buckets: make(map[string]map[string]json.RawMessage)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading store: %w", err)
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(data, &s.buckets); err != nil {
+		return nil, fmt.Errorf("parsing store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// in-memory store for defaults before main has opened the real one
+func Memory() *Store {
+	return &Store{buckets: make(map[string]map[string]json.RawMessage)}
+}
+
+// decodes bucket/key into v, found is false if there's nothing stored
+func (s *Store) Get(bucket, key string, v any) (bool, error) {
+	s.mu.Lock()
+	raw, ok := s.buckets[bucket][key]
+	s.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return true, fmt.Errorf("decoding %s/%s: %w", bucket, key, err)
+	}
+	return true, nil
+}
+
+func (s *Store) Put(bucket, key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %s/%s: %w", bucket, key, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string]json.RawMessage)
+	}
+	s.buckets[bucket][key] = raw
+	s.dirty = true
+	return s.write()
+}
+
+func (s *Store) Delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[bucket][key]; !ok {
+		return nil
+	}
+	delete(s.buckets[bucket], key)
+	s.dirty = true
+	return s.write()
+}
+
+// sorted keys in bucket
+func (s *Store) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writes anything a failed Put/Delete couldn't get to disk
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.write()
+}
+
+// Close writes what's left and stops writing, it's the last thing go-apts does before exiting
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.write()
+	s.closed = true
+	return err
+}
+
+func (s *Store) write() error {
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+	if s.closed {
+		return fmt.Errorf("store %s is closed", s.path)
+	}
+
+	data, err := json.MarshalIndent(s.buckets, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding store: %w", err)
+	}
+
+	// write then rename so a crash mid-write never leaves a half written store
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("writing store: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("replacing store: %w", err)
+	}
+
+	s.dirty = false
+	return nil
+}
@@ -0,0 +1,125 @@
+package subscribers
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	store "github.com/anthonybliss1/go-apts/internal/store"
+)
+
+const bucket = "telegram_subscribers"
+
+// All in Watches subscribes a chat to every watch, including ones added later
+const All = "*"
+
+// Subscriber is a telegram chat (private, group, channel, or one topic of a forum group) that gets alerts
+type Subscriber struct {
+	ChatID   string
+	ThreadID int // forum topic, 0 for the whole chat
+	Title    string
+	Type     string   // private, group, supergroup or channel
+	Watches  []string // watch ids, or All
+	AddedAt  time.Time
+}
+
+// Key is how a subscriber is stored and how it's written in a watch's telegram target: chat_id or chat_id:thread_id
+func (s Subscriber) Key() string {
+	return Target_key(s.ChatID, s.ThreadID)
+}
+
+func (s Subscriber) Follows(watch_id string) bool {
+	return slices.Contains(s.Watches, All) || (watch_id != "" && slices.Contains(s.Watches, watch_id))
+}
+
+func Target_key(chat_id string, thread_id int) string {
+	if thread_id == 0 {
+		return chat_id
+	}
+	return fmt.Sprintf("%s:%d", chat_id, thread_id)
+}
+
+// Parse_target splits "chat_id" or "chat_id:thread_id"
+func Parse_target(target string) (string, int, error) {
+	chat_id, thread, found := strings.Cut(strings.TrimSpace(target), ":")
+	if !found {
+		return chat_id, 0, nil
+	}
+
+	thread_id, err := strconv.Atoi(thread)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad telegram target %q, expected chat_id or chat_id:thread_id", target)
+	}
+	return chat_id, thread_id, nil
+}
+
+type Subscribers struct {
+	store *store.Store
+}
+
+func New(s *store.Store) *Subscribers {
+	return &Subscribers{store: s}
+}
+
+func (s *Subscribers) Save(sub Subscriber) error {
+	if sub.AddedAt.IsZero() {
+		sub.AddedAt = time.Now()
+	}
+	return s.store.Put(bucket, sub.Key(), sub)
+}
+
+func (s *Subscribers) Get(key string) (Subscriber, bool, error) {
+	var sub Subscriber
+	found, err := s.store.Get(bucket, key, &sub)
+	return sub, found, err
+}
+
+func (s *Subscribers) Remove(key string) error {
+	return s.store.Delete(bucket, key)
+}
+
+func (s *Subscribers) List() ([]Subscriber, error) {
+	var all []Subscriber
+	for _, key := range s.store.Keys(bucket) {
+		sub, found, err := s.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			all = append(all, sub)
+		}
+	}
+	return all, nil
+}
+
+// For_watch is every subscriber following watch_id
+func (s *Subscribers) For_watch(watch_id string) ([]Subscriber, error) {
+	all, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var following []Subscriber
+	for _, sub := range all {
+		if sub.Follows(watch_id) {
+			following = append(following, sub)
+		}
+	}
+	return following, nil
+}
+
+// Has_chat is true if any subscriber (any topic) is in chat_id, used to authorise commands and buttons
+func (s *Subscribers) Has_chat(chat_id string) bool {
+	all, err := s.List()
+	if err != nil {
+		return false
+	}
+	for _, sub := range all {
+		if sub.ChatID == chat_id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package unitstate
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	utils "github.com/anthonybliss1/go-apts/api/utils"
+	store "github.com/anthonybliss1/go-apts/internal/store"
+)
+
+const bucket = "unit_state"
+
+// what people have said about a unit from the alert buttons
+type Unit_state struct {
+	Muted      bool // hidden from later alerts
+	Interested bool // price changes get highlighted
+	Toured     bool
+	UpdatedAt  time.Time
+}
+
+type Listing_state struct {
+	SnoozedUntil time.Time             // no alerts for the listing until then
+	Units        map[string]Unit_state // keyed by Unit_id
+}
+
+func (l Listing_state) Snoozed(now time.Time) bool {
+	return now.Before(l.SnoozedUntil)
+}
+
+func (l Listing_state) Unit(unit_id string) Unit_state {
+	return l.Units[unit_id]
+}
+
+// short stable ids. telegram callback data is capped at 64 bytes so full URLs don't fit
+func short_id(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:5])
+}
+
+func Listing_id(listing_url string) string {
+	return short_id(utils.Canonical_url(listing_url))
+}
+
+// unit_key is history.Unit_key of the unit
+func Unit_id(unit_key string) string {
+	return short_id(unit_key)
+}
+
+type States struct {
+	mu    sync.Mutex // button presses can land at the same time, keep read-modify-write whole
+	store *store.Store
+}
+
+func New(s *store.Store) *States {
+	return &States{store: s}
+}
+
+func (s *States) Get(listing_id string) (Listing_state, error) {
+	var l Listing_state
+	_, err := s.store.Get(bucket, listing_id, &l)
+	if l.Units == nil {
+		l.Units = make(map[string]Unit_state)
+	}
+	return l, err
+}
+
+func (s *States) update(listing_id string, fn func(*Listing_state)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, err := s.Get(listing_id)
+	if err != nil {
+		return err
+	}
+	fn(&l)
+	return s.store.Put(bucket, listing_id, l)
+}
+
+func (s *States) Snooze(listing_id string, d time.Duration) error {
+	return s.update(listing_id, func(l *Listing_state) {
+		l.SnoozedUntil = time.Now().Add(d)
+	})
+}
+
+// Update_unit applies fn to one unit's state
+func (s *States) Update_unit(listing_id string, unit_id string, fn func(*Unit_state)) error {
+	return s.update(listing_id, func(l *Listing_state) {
+		u := l.Units[unit_id]
+		fn(&u)
+		u.UpdatedAt = time.Now()
+		l.Units[unit_id] = u
+	})
+}
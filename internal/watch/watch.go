@@ -0,0 +1,120 @@
+package watch
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	digest "github.com/anthonybliss1/go-apts/internal/digest"
+	rules "github.com/anthonybliss1/go-apts/internal/rules"
+	store "github.com/anthonybliss1/go-apts/internal/store"
+)
+
+const bucket = "watches"
+
+// Watch is a listing someone wants to hear about and the channels to tell them on
+type Watch struct {
+	ID         string
+	URL        string
+	Channels   []string
+	Targets    map[string]string        // per-channel destination for this watch (e.g. "slack" -> webhook URL)
+	TargetRent float64                  // new units at or under this rent are sent as high priority
+	Templates  map[string]string        // per-channel notification template (or "default" for all), see notify.Channel_template
+	Delivery   map[string]digest.Policy // per-channel (or "default") realtime / digest and quiet hours
+	Rules      []rules.Rule             // price drop / target / cheapest unit triggers, each fires an alert of its own
+	CreatedAt  time.Time
+
+	// scheduled checks run inside go-apts (see internal/scheduler), empty Interval means only on demand
+	Interval  string // hourly, daily or weekly
+	Paused    bool
+	ChatID    string // telegram chat that created the watch with /watch, if any
+	LastRun   time.Time
+	LastError string
+}
+
+var intervals = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// how often wt should run, false if it isn't scheduled
+func (wt Watch) Every() (time.Duration, bool) {
+	d, ok := intervals[wt.Interval]
+	return d, ok
+}
+
+func Valid_interval(interval string) bool {
+	_, ok := intervals[interval]
+	return ok || interval == ""
+}
+
+// scheduled, not paused and not run within its interval
+func (wt Watch) Due(now time.Time) bool {
+	every, ok := wt.Every()
+	return ok && !wt.Paused && now.Sub(wt.LastRun) >= every
+}
+
+type Watches struct {
+	store *store.Store
+}
+
+func New(s *store.Store) *Watches {
+	return &Watches{store: s}
+}
+
+// short ids so they're easy to type back (e.g. in a DELETE or a chat command)
+func new_id() (string, error) {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating watch id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Add gives wt an id and stores it
+func (w *Watches) Add(wt Watch) (Watch, error) {
+	id, err := new_id()
+	if err != nil {
+		return Watch{}, err
+	}
+
+	wt.ID = id
+	wt.CreatedAt = time.Now()
+	if err := w.Save(wt); err != nil {
+		return Watch{}, err
+	}
+	return wt, nil
+}
+
+func (w *Watches) Save(wt Watch) error {
+	return w.store.Put(bucket, wt.ID, wt)
+}
+
+func (w *Watches) Get(id string) (Watch, bool, error) {
+	var wt Watch
+	found, err := w.store.Get(bucket, id, &wt)
+	return wt, found, err
+}
+
+func (w *Watches) List() ([]Watch, error) {
+	var all []Watch
+	for _, id := range w.store.Keys(bucket) {
+		wt, found, err := w.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			all = append(all, wt)
+		}
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].CreatedAt.Before(all[j].CreatedAt) })
+	return all, nil
+}
+
+func (w *Watches) Remove(id string) error {
+	return w.store.Delete(bucket, id)
+}